@@ -0,0 +1,172 @@
+package irisdb
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/alimx07/IrisDB/db"
+	"github.com/alimx07/IrisDB/skiplist"
+)
+
+var ErrInvalidBatch = errors.New("invalid write batch")
+
+const batchHeader = 4
+
+// WriteBatch holds updates that are applied to the DB atomically
+// all of them share one timestamp and one WAL record
+type WriteBatch struct {
+	/*
+	   BATCH LAYOUT
+	   ---------------------------------------------------------------------
+	   | Count(4) | Op(1) | KeyLen(2) | ValueLen(4) | Key | Value | ...     |
+	   ---------------------------------------------------------------------
+	*/
+	data []byte
+	err  error
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{data: make([]byte, batchHeader)}
+}
+
+// Put adds key-value pair to the batch
+func (b *WriteBatch) Put(key, value []byte) {
+	b.add(OpPut, key, value)
+}
+
+// Delete adds a tombstone of key to the batch
+func (b *WriteBatch) Delete(key []byte) {
+	b.add(OpDelete, key, nil)
+}
+
+func (b *WriteBatch) add(op byte, key, value []byte) {
+	if b.err != nil {
+		return
+	}
+	if b.err = checkKey(key); b.err != nil {
+		return
+	}
+	var hdr [7]byte
+	hdr[0] = op
+	binary.BigEndian.PutUint16(hdr[1:3], uint16(len(key)))
+	binary.BigEndian.PutUint32(hdr[3:7], uint32(len(value)))
+	b.data = append(b.data, hdr[:]...)
+	b.data = append(b.data, key...)
+	b.data = append(b.data, value...)
+	binary.BigEndian.PutUint32(b.data[:batchHeader], uint32(b.Count()+1))
+}
+
+func checkKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	return nil
+}
+
+// Clear removes all updates from the batch
+func (b *WriteBatch) Clear() {
+	b.data = b.data[:batchHeader]
+	clear(b.data)
+	b.err = nil
+}
+
+// Count returns number of updates in the batch
+func (b *WriteBatch) Count() int {
+	return int(binary.BigEndian.Uint32(b.data[:batchHeader]))
+}
+
+// Serialize returns the encoded batch
+func (b *WriteBatch) Serialize() []byte {
+	data := make([]byte, len(b.data))
+	copy(data, b.data)
+	return data
+}
+
+// DeserializeWriteBatch decodes a batch written by Serialize
+func DeserializeWriteBatch(data []byte) (*WriteBatch, error) {
+	if len(data) < batchHeader {
+		return nil, ErrInvalidBatch
+	}
+	b := &WriteBatch{data: make([]byte, len(data))}
+	copy(b.data, data)
+
+	// walk the entries once so a bad batch fails here
+	n := 0
+	err := b.forEach(func(byte, []byte, []byte) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if n != b.Count() {
+		return nil, ErrInvalidBatch
+	}
+	return b, nil
+}
+
+func (b *WriteBatch) forEach(fn func(op byte, key, value []byte) error) error {
+	data := b.data[batchHeader:]
+	for len(data) > 0 {
+		if len(data) < 7 {
+			return ErrInvalidBatch
+		}
+		op := data[0]
+		keyLen := int(binary.BigEndian.Uint16(data[1:3]))
+		valueLen := int(binary.BigEndian.Uint32(data[3:7]))
+		if (op != OpPut && op != OpDelete) || len(data) < 7+keyLen+valueLen {
+			return ErrInvalidBatch
+		}
+		key := data[7 : 7+keyLen]
+		value := data[7+keyLen : 7+keyLen+valueLen]
+		if err := fn(op, key, value); err != nil {
+			return err
+		}
+		data = data[7+keyLen+valueLen:]
+	}
+	return nil
+}
+
+// upper bound of the memtable space needed for the batch
+func (b *WriteBatch) memSize() uint32 {
+	var size uint32
+	b.forEach(func(op byte, key, value []byte) error {
+		if op == OpDelete {
+			value = TOMPOSTONE
+		}
+		size += skiplist.MaxSize + uint32(len(key)+8+len(value)) + 4
+		return nil
+	})
+	return size
+}
+
+// apply inserts all updates of the batch into mem at ts
+func (b *WriteBatch) apply(mem *skiplist.SkipList, ts uint64) error {
+	return b.forEach(func(op byte, key, value []byte) error {
+		if op == OpDelete {
+			value = TOMPOSTONE
+		}
+		return mem.Insert(db.NewKeyAt(key, ts), db.NewValue(value))
+	})
+}
+
+// batch wal record carries the shared timestamp in its key
+func batchEntry(b *WriteBatch, ts uint64) *LogEntry {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, ts)
+	return &LogEntry{Op: OpBatch, Key: k, Value: b.data}
+}
+
+func batchFromEntry(entry *LogEntry) (*WriteBatch, uint64, error) {
+	if len(entry.Key) != 8 {
+		return nil, 0, ErrInvalidBatch
+	}
+	b, err := DeserializeWriteBatch(entry.Value)
+	if err != nil {
+		return nil, 0, err
+	}
+	return b, binary.BigEndian.Uint64(entry.Key), nil
+}
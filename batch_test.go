@@ -0,0 +1,113 @@
+package irisdb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alimx07/IrisDB/skiplist"
+)
+
+// newest log of the DB in dir
+func lastWal(t *testing.T, dir string) string {
+	t.Helper()
+	wals, err := filepath.Glob(filepath.Join(dir, "*"+WalExtension))
+	if err != nil || len(wals) == 0 {
+		t.Fatalf("no logs in %s: %v", dir, err)
+	}
+	// names are zero padded numbers
+	return wals[len(wals)-1]
+}
+
+func TestBatchReplay(t *testing.T) {
+	dir := t.TempDir()
+	DB := openTestDB(t, dir, nil)
+	small := NewWriteBatch()
+	for i := range 10 {
+		small.Put(testKey(i), testValue(i))
+	}
+	small.Delete(testKey(3))
+	if err := DB.Write(small, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// record spans several pages
+	big := NewWriteBatch()
+	for i := 100; i < 200; i++ {
+		big.Put(testKey(i), bytes.Repeat([]byte{'v'}, 100))
+	}
+	if err := DB.Write(big, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// crash tore the last page of the big batch
+	wal := lastWal(t, dir)
+	info, err := os.Stat(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(wal, info.Size()-4096); err != nil {
+		t.Fatal(err)
+	}
+
+	DB = openTestDB(t, dir, nil)
+	defer DB.Close()
+	for i := range 10 {
+		want := testValue(i)
+		if i == 3 {
+			want = nil
+		}
+		checkRead(t, DB, testKey(i), want)
+	}
+	// nothing of a torn batch is applied
+	for i := 100; i < 200; i++ {
+		checkRead(t, DB, testKey(i), nil)
+	}
+}
+
+func TestBatchTooLarge(t *testing.T) {
+	dir := t.TempDir()
+	DB := openTestDB(t, dir, nil)
+	defer DB.Close()
+
+	// a single put that needs n bytes of the memtable
+	batch := func(n uint32) *WriteBatch {
+		b := NewWriteBatch()
+		b.Put([]byte("k"), bytes.Repeat([]byte{'v'}, int(n-skiplist.MaxSize-1-8-4)))
+		if b.memSize() != n {
+			t.Fatalf("memSize = %d, want %d", b.memSize(), n)
+		}
+		return b
+	}
+	wals := func() int {
+		files, err := filepath.Glob(filepath.Join(dir, "*"+WalExtension))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(files)
+	}
+	room := skiplist.Room(uint32(DB.opts.MemTableSize))
+
+	// one byte over fits no memtable. so nothing rotates
+	before := wals()
+	if err := DB.Write(batch(room+1), nil); err != ErrBatchTooLarge {
+		t.Fatalf("err = %v, want ErrBatchTooLarge", err)
+	}
+	if n := wals(); n != before {
+		t.Fatalf("%d logs after a rejected batch, want %d", n, before)
+	}
+
+	// exactly room fits an empty memtable
+	if err := DB.Write(batch(room), nil); err != nil {
+		t.Fatal(err)
+	}
+	// and the next one rotates once
+	if err := DB.Write(batch(room), nil); err != nil {
+		t.Fatal(err)
+	}
+	checkRead(t, DB, []byte("k"), bytes.Repeat([]byte{'v'}, int(room-skiplist.MaxSize-1-8-4)))
+}
@@ -1,11 +1,16 @@
 package irisdb
 
 import (
-	"bytes"
 	"encoding/binary"
-	"encoding/gob"
+	"errors"
+
+	"github.com/alimx07/IrisDB/db"
 )
 
+var ErrInvalidBlock = errors.New("invalid serialized block")
+
+// every key inside block is stored as
+// | ValPgNum(4) | Key + Ts |
 type Block struct {
 	keys [][]byte
 }
@@ -32,46 +37,99 @@ func (i *IndexBlock) find(x byte) (uint32, bool) {
 	return 0, false
 }
 
-func (b *Block) find(key []byte) (uint16, bool) {
+// find newest version of key with ts <= ts
+// returns value page and ts of the version
+func (b *Block) find(key []byte, ts uint64) (uint32, uint64, bool) {
 	// here i will apply binary search on block
+	// keys sorted by (key asc, ts desc) so the first
+	// entry >= (key, ts) is the version we want
 
-	l, h := 0, len(b.keys)-1
-	mid := (l + h) / 2
-	for l <= h {
-		cmp := bytes.Compare(key, b.keys[mid][2:])
-		if cmp == 0 {
-			return binary.BigEndian.Uint16(b.keys[mid][:2]), true
+	target := db.NewKeyAt(key, ts)
+	l, h := 0, len(b.keys)
+	for l < h {
+		mid := (l + h) / 2
+		if db.CompareKeys(b.keys[mid][ValPtrSize:], target) < 0 {
+			l = mid + 1
+		} else {
+			h = mid
 		}
-		if cmp < 0 {
-			h = mid - 1
+	}
+	if l == len(b.keys) || db.CompareRawKeys(b.keys[l][ValPtrSize:], target) != 0 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint32(b.keys[l][:ValPtrSize]), db.GetTsAsUint64(b.keys[l][ValPtrSize:]), true
+}
+
+func DeserializeBlock(data []byte) (*Block, error) {
+	if len(data) < 4 {
+		return nil, ErrInvalidBlock
+	}
+	n := binary.BigEndian.Uint32(data[:4])
+	data = data[4:]
+	b := &Block{keys: make([][]byte, 0, n)}
+	for range n {
+		if len(data) < 2 {
+			return nil, ErrInvalidBlock
 		}
-		l = mid + 1
+		sz := int(binary.BigEndian.Uint16(data[:2]))
+		if len(data) < 2+sz {
+			return nil, ErrInvalidBlock
+		}
+		b.keys = append(b.keys, data[2:2+sz])
+		data = data[2+sz:]
 	}
-	return 0, false
+	return b, nil
 }
 
-func DeserializeBlock(buf bytes.Buffer) *Block {
-	dec := gob.NewDecoder(&buf)
+func (b *Block) SerializeBlock() []byte {
 
-	var b *Block
-	dec.Decode(b)
-	return b
+	/*
+		BLOCK LAYOUT
+		------------------------------------------------
+		| Count(4) | KeyLen(2) | Key | KeyLen(2) | ... |
+		------------------------------------------------
+	*/
+
+	sz := 4
+	for _, k := range b.keys {
+		sz += 2 + len(k)
+	}
+	data := make([]byte, 4, sz)
+	binary.BigEndian.PutUint32(data, uint32(len(b.keys)))
+	for _, k := range b.keys {
+		data = binary.BigEndian.AppendUint16(data, uint16(len(k)))
+		data = append(data, k...)
+	}
+	return data
 }
 
-func (b *Block) SerializeBlock(buf bytes.Buffer) {
-	enc := gob.NewEncoder(&buf)
-	enc.Encode(b)
+func DeserializeIndex(data []byte) (*IndexBlock, error) {
+	if len(data)%5 != 0 {
+		return nil, ErrInvalidBlock
+	}
+	i := &IndexBlock{entries: make([]IndexEntry, 0, len(data)/5)}
+	for ; len(data) > 0; data = data[5:] {
+		i.entries = append(i.entries, IndexEntry{
+			key: data[0],
+			off: binary.BigEndian.Uint32(data[1:5]),
+		})
+	}
+	return i, nil
 }
 
-func DeserializeIndex(buf bytes.Buffer) *IndexBlock {
-	dec := gob.NewDecoder(&buf)
+func (i *IndexBlock) SerializeIndex() []byte {
 
-	var i *IndexBlock
-	dec.Decode(i)
-	return i
-}
+	/*
+		INDEX LAYOUT
+		----------------------------------
+		| Key(1) | Off(4) | Key(1) | ... |
+		----------------------------------
+	*/
 
-func (i *IndexBlock) SerializeIndex(buf bytes.Buffer) {
-	enc := gob.NewEncoder(&buf)
-	enc.Encode(i)
+	data := make([]byte, 0, len(i.entries)*5)
+	for _, entry := range i.entries {
+		data = append(data, entry.key)
+		data = binary.BigEndian.AppendUint32(data, entry.off)
+	}
+	return data
 }
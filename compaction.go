@@ -0,0 +1,234 @@
+package irisdb
+
+import (
+	"math"
+	"slices"
+	"sort"
+
+	"github.com/alimx07/IrisDB/db"
+)
+
+// max total size of level
+// SizeLevel(i) = SstableSize * Multiple^i
+func maxLevelSize(level int, opts *Options) uint64 {
+	return uint64(float64(opts.SstableSize) * math.Pow(float64(opts.SizeMultiple), float64(level)))
+}
+
+// target size of one table. compaction splits its output at
+// SstableSize so a table never outgrows the budget of its level.
+// level-0 tables hold a whole memtable
+func tableSize(level int, opts *Options) uint64 {
+	if level == 0 {
+		return uint64(max(opts.SstableSize, opts.MemTableSize))
+	}
+	return uint64(opts.SstableSize)
+}
+
+func levelSize(tables []*SSTABLE) uint64 {
+	var sz uint64
+	for _, sst := range tables {
+		sz += sst.Size()
+	}
+	return sz
+}
+
+// keep tables of level > 0 sorted by their smallest key
+func sortLevel(tables []*SSTABLE) {
+	sort.Slice(tables, func(i, j int) bool {
+		return db.CompareKeys(tables[i].smallest, tables[j].smallest) < 0
+	})
+}
+
+// check if table keys intersect the raw range [lo, hi]
+func (sst *SSTABLE) overlaps(lo, hi []byte) bool {
+	return db.CompareRawKeys(sst.largest, lo) >= 0 && db.CompareRawKeys(sst.smallest, hi) <= 0
+}
+
+// raw range covering all tables (keys keep their ts)
+func keyRange(tables []*SSTABLE) ([]byte, []byte) {
+	lo, hi := tables[0].smallest, tables[0].largest
+	for _, sst := range tables[1:] {
+		if db.CompareRawKeys(sst.smallest, lo) < 0 {
+			lo = sst.smallest
+		}
+		if db.CompareRawKeys(sst.largest, hi) > 0 {
+			hi = sst.largest
+		}
+	}
+	return lo, hi
+}
+
+func (DB *IrisDB) scheduleCompaction() {
+	select {
+	case DB.compactC <- struct{}{}:
+	default:
+		// compaction already pending
+	}
+}
+
+// compact levels in background until every level fits its size
+func (DB *IrisDB) compact() {
+	defer DB.wg.Done()
+	for {
+		select {
+		case <-DB.compactC:
+		case <-DB.close:
+			return
+		}
+		for {
+			select {
+			case <-DB.close:
+				return
+			default:
+			}
+
+			done, err := DB.compactOnce()
+			if err != nil {
+				DB.setBackgroundError(err)
+				break
+			}
+			if !done {
+				break
+			}
+		}
+	}
+}
+
+type compaction struct {
+	level    int        // input level. outputs go to level + 1
+	inputs   []*SSTABLE // tables from level (newest first)
+	overlaps []*SSTABLE // tables from level + 1
+	bottom   bool       // nothing older below level + 1
+}
+
+// choose the level with the highest size/limit score
+// the last level is never compacted
+func (DB *IrisDB) pickCompaction() *compaction {
+	DB.mu.RLock()
+	defer DB.mu.RUnlock()
+
+	level, best := -1, 1.0
+	for lv := 0; lv < len(DB.sstables)-1; lv++ {
+		score := float64(levelSize(DB.sstables[lv])) / float64(maxLevelSize(lv, DB.opts))
+		if score > best {
+			level, best = lv, score
+		}
+	}
+	if level == -1 {
+		return nil
+	}
+	c := &compaction{level: level}
+
+	if level == 0 {
+		// level 0 tables overlap each other
+		// so all of them must move together
+		c.inputs = append(c.inputs, DB.sstables[0]...)
+	} else {
+		// round robin over the level key space
+		tables := DB.sstables[level]
+		c.inputs = []*SSTABLE{tables[0]}
+		if ptr := DB.compactPtr[level]; ptr != nil {
+			for _, sst := range tables {
+				if db.CompareRawKeys(sst.smallest, ptr) > 0 {
+					c.inputs = []*SSTABLE{sst}
+					break
+				}
+			}
+		}
+	}
+
+	lo, hi := keyRange(c.inputs)
+	for _, sst := range DB.sstables[level+1] {
+		if sst.overlaps(lo, hi) {
+			c.overlaps = append(c.overlaps, sst)
+		}
+	}
+
+	c.bottom = true
+	for _, lv := range DB.sstables[level+2:] {
+		if len(lv) > 0 {
+			c.bottom = false
+			break
+		}
+	}
+	return c
+}
+
+// run one compaction. return false if nothing to compact
+func (DB *IrisDB) compactOnce() (bool, error) {
+	c := DB.pickCompaction()
+	if c == nil {
+		return false, nil
+	}
+
+	// newer tables first. so merge keeps their versions
+	smi, err := NewSSTMergeIterator(c.tables(), c.level+1)
+	if err != nil {
+		return false, err
+	}
+	smi.dropTombstones = c.bottom
+	smi.snapshots = DB.snapshotTimes()
+	now := db.Now()
+	smi.retain = now - min(now, uint64(DB.opts.HistoryRetention))
+	outputs, err := smi.CreateSST(DB.path, DB.newFileNum, DB.opts)
+	if err != nil {
+		return false, err
+	}
+	if err := DB.installCompaction(c, outputs, smi.horizon); err != nil {
+		for _, sst := range outputs {
+			sst.remove()
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// swap compaction inputs with outputs in one step
+// the manifest edit makes the swap durable before anyone sees it
+// horizon is the newest ts of a version that replaced a dropped one
+func (DB *IrisDB) installCompaction(c *compaction, outputs []*SSTABLE, horizon uint64) error {
+	edit := &versionEdit{nextFile: DB.nextFile.Load(), horizon: horizon}
+	for _, sst := range outputs {
+		edit.added = append(edit.added, metaOf(c.level+1, sst))
+	}
+	for _, sst := range c.inputs {
+		edit.deleted = append(edit.deleted, metaOf(c.level, sst))
+	}
+	for _, sst := range c.overlaps {
+		edit.deleted = append(edit.deleted, metaOf(c.level+1, sst))
+	}
+
+	DB.mu.Lock()
+	if err := DB.manifest.logEdit(edit); err != nil {
+		DB.mu.Unlock()
+		return err
+	}
+	levels := DB.cloneLevels()
+	levels[c.level] = removeTables(levels[c.level], c.inputs)
+	next := append(removeTables(levels[c.level+1], c.overlaps), outputs...)
+	sortLevel(next)
+	levels[c.level+1] = next
+	DB.sstables = levels
+	if horizon > DB.horizon.Load() {
+		DB.horizon.Store(horizon)
+	}
+	_, hi := keyRange(c.inputs)
+	DB.compactPtr[c.level] = hi
+	DB.mu.Unlock()
+
+	for _, sst := range c.tables() {
+		sst.obsolete.Store(true)
+		sst.unref()
+	}
+	return nil
+}
+
+func (c *compaction) tables() []*SSTABLE {
+	return append(append([]*SSTABLE(nil), c.inputs...), c.overlaps...)
+}
+
+func removeTables(level, tables []*SSTABLE) []*SSTABLE {
+	return slices.DeleteFunc(level, func(sst *SSTABLE) bool {
+		return slices.Contains(tables, sst)
+	})
+}
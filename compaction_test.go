@@ -0,0 +1,181 @@
+package irisdb
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/alimx07/IrisDB/db"
+)
+
+// wait until every level fits its size
+func waitCompacted(t *testing.T, DB *IrisDB) {
+	t.Helper()
+	waitFlushed(t, DB)
+	deadline := time.Now().Add(10 * time.Second)
+	for DB.pickCompaction() != nil {
+		if err := DB.backgroundError(); err != nil {
+			t.Fatal(err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("compaction didn't finish")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func compactOptions() *Options {
+	opts := smallOptions()
+	opts.PageSize = 512
+	opts.SstableSize = 4096
+	opts.SizeMultiple = 2
+	return opts
+}
+
+func TestCompaction(t *testing.T) {
+	dir := t.TempDir()
+	DB := openTestDB(t, dir, compactOptions())
+
+	// three rounds of overwrites then delete every 10th key
+	const n = 300
+	for round := range 3 {
+		for i := range n {
+			if err := DB.Put(testKey(i), testValue(i+round*n), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < n; i += 10 {
+		DB.Delete(testKey(i), nil)
+	}
+	waitCompacted(t, DB)
+
+	DB.mu.RLock()
+	deeper := 0
+	for lv := 1; lv < len(DB.sstables); lv++ {
+		tables := DB.sstables[lv]
+		deeper += len(tables)
+		for i, sst := range tables {
+			// splitting at SstableSize may overshoot by a block
+			if sst.Size() > 2*uint64(DB.opts.SstableSize) {
+				t.Errorf("level %d table of %d bytes", lv, sst.Size())
+			}
+			if i > 0 && db.CompareRawKeys(tables[i-1].largest, sst.smallest) >= 0 {
+				t.Errorf("level %d tables overlap", lv)
+			}
+		}
+	}
+	DB.mu.RUnlock()
+	if deeper == 0 {
+		t.Fatal("Expected tables below level 0")
+	}
+
+	check := func() {
+		for i := range n {
+			want := testValue(i + 2*n)
+			if i%10 == 0 {
+				want = nil
+			}
+			checkRead(t, DB, testKey(i), want)
+		}
+	}
+	check()
+	if err := DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	DB = openTestDB(t, dir, compactOptions())
+	defer DB.Close()
+	check()
+}
+
+func TestReadAtCompacted(t *testing.T) {
+	dir := t.TempDir()
+	DB := openTestDB(t, dir, compactOptions())
+
+	key := []byte("key")
+	DB.Put(key, []byte("old"), nil)
+	_, oldTs, _ := DB.getVersion(key, math.MaxUint64, true)
+	DB.Put(key, []byte("new"), nil)
+	_, newTs, _ := DB.getVersion(key, math.MaxUint64, true)
+
+	// before compaction every version is readable
+	if val, err := DB.ReadAt(key, time.Unix(0, int64(oldTs)), nil); err != nil || string(val) != "old" {
+		t.Fatalf("Expected old, got %q, %v", val, err)
+	}
+	for i := range 300 {
+		if err := DB.Put(testKey(i), testValue(i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitCompacted(t, DB)
+
+	check := func() {
+		t.Helper()
+		if _, err := DB.ReadAt(key, time.Unix(0, int64(oldTs)), nil); !errors.Is(err, ErrTsCompacted) {
+			t.Errorf("Expected ErrTsCompacted, got %v", err)
+		}
+		it := DB.NewIteratorAt(nil, nil, time.Unix(0, int64(oldTs)), nil)
+		if !errors.Is(it.Error(), ErrTsCompacted) {
+			t.Errorf("Expected iterator ErrTsCompacted, got %v", it.Error())
+		}
+		it.Close()
+		if val, err := DB.ReadAt(key, time.Unix(0, int64(newTs)), nil); err != nil || string(val) != "new" {
+			t.Errorf("Expected new, got %q, %v", val, err)
+		}
+	}
+	check()
+
+	// horizon survives restart
+	if err := DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	DB = openTestDB(t, dir, compactOptions())
+	defer DB.Close()
+	check()
+}
+
+func TestReadAtRetention(t *testing.T) {
+	dir := t.TempDir()
+	opts := compactOptions()
+	opts.HistoryRetention = time.Hour
+	DB := openTestDB(t, dir, opts)
+
+	key := []byte("key")
+	var stamps []uint64
+	for _, val := range []string{"v1", "v2", "v3"} {
+		DB.Put(key, []byte(val), nil)
+		_, ts, _ := DB.getVersion(key, math.MaxUint64, true)
+		stamps = append(stamps, ts)
+	}
+	DB.Delete(key, nil)
+	for round := range 3 {
+		for i := range 300 {
+			DB.Put(testKey(i), testValue(i+round), nil)
+		}
+	}
+	waitCompacted(t, DB)
+
+	check := func() {
+		t.Helper()
+		for i, ts := range stamps {
+			want := fmt.Sprintf("v%d", i+1)
+			if val, err := DB.ReadAt(key, time.Unix(0, int64(ts)), nil); err != nil || string(val) != want {
+				t.Errorf("Expected %s at %d, got %q, %v", want, ts, val, err)
+			}
+		}
+		checkRead(t, DB, key, nil)
+		checkRead(t, DB, testKey(0), testValue(2))
+	}
+
+	// overwritten versions within the retention survive
+	// compaction and a restart
+	check()
+	if err := DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	DB = openTestDB(t, dir, opts)
+	defer DB.Close()
+	check()
+}
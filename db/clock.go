@@ -0,0 +1,39 @@
+package db
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// hybrid logical clock of key timestamps
+// ts follow wall time (unix ns) so they can be used for time travel
+// but never repeat or go backward when the wall clock steps back
+// or two versions are stamped in the same nanosecond
+var clock atomic.Uint64
+
+// Now returns a ts newer than every ts returned before
+func Now() uint64 {
+	for {
+		last := clock.Load()
+		ts := max(uint64(time.Now().UnixNano()), last+1)
+		if clock.CompareAndSwap(last, ts) {
+			return ts
+		}
+	}
+}
+
+// Last returns the newest ts handed out (or observed)
+func Last() uint64 {
+	return clock.Load()
+}
+
+// Observe moves the clock past ts
+// (ts recovered from disk must never be handed out again)
+func Observe(ts uint64) {
+	for {
+		last := clock.Load()
+		if ts <= last || clock.CompareAndSwap(last, ts) {
+			return
+		}
+	}
+}
@@ -3,7 +3,6 @@ package db
 import (
 	"bytes"
 	"encoding/binary"
-	"time"
 )
 
 const (
@@ -14,10 +13,22 @@ const (
 // key operations
 // New functions will be added
 
+// NewKey builds the internal key of k at a fresh clock ts
 func NewKey(k []byte) []byte {
-	t := time.Now().UnixNano()
-	return binary.BigEndian.AppendUint64(k, uint64(t))
+	return NewKeyAt(k, Now())
+}
+
+// NewKeyAt builds the internal key of k at ts
+// k is copied so the caller's slice is never appended to
+func NewKeyAt(k []byte, ts uint64) []byte {
+	key := make([]byte, len(k), len(k)+lenTs)
+	copy(key, k)
+	return binary.BigEndian.AppendUint64(key, ts)
+}
 
+// RawKey strips the timestamp of an internal key
+func RawKey(k []byte) []byte {
+	return k[:len(k)-lenTs]
 }
 
 func CompareRawKeys(k1, k2 []byte) int {
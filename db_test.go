@@ -0,0 +1,626 @@
+package irisdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alimx07/IrisDB/db"
+	"github.com/alimx07/IrisDB/page"
+	"github.com/alimx07/IrisDB/skiplist"
+)
+
+func openTestDB(t *testing.T, dir string, opts *Options) *IrisDB {
+	t.Helper()
+	DB, err := OpenDB(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return DB
+}
+
+func testKey(i int) []byte {
+	return []byte(fmt.Sprintf("key-%05d", i))
+}
+
+func testValue(i int) []byte {
+	return []byte(fmt.Sprintf("value-%d", i))
+}
+
+// expect key to hold want (nil for missing)
+func checkRead(t *testing.T, DB *IrisDB, key, want []byte) {
+	t.Helper()
+	val, err := DB.Read(key, nil)
+	if err != nil {
+		t.Fatalf("Read %s failed: %v", key, err)
+	}
+	if string(val) != string(want) || (val == nil) != (want == nil) {
+		t.Fatalf("Read %s: expected %q, got %q", key, want, val)
+	}
+}
+
+// options that flush after a few dozen puts
+func smallOptions() *Options {
+	return &Options{MemTableSize: 16 * int(skiplist.MaxSize)}
+}
+
+// wait until every immutable memtable is flushed
+func waitFlushed(t *testing.T, DB *IrisDB) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		DB.mu.RLock()
+		n := len(DB.memtables)
+		DB.mu.RUnlock()
+		if n == 1 {
+			return
+		}
+		if err := DB.backgroundError(); err != nil {
+			t.Fatal(err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d memtables still not flushed", n-1)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func tableCount(DB *IrisDB) int {
+	DB.mu.RLock()
+	defer DB.mu.RUnlock()
+	n := 0
+	for _, lv := range DB.sstables {
+		n += len(lv)
+	}
+	return n
+}
+
+func TestPutDelete(t *testing.T) {
+	DB := openTestDB(t, t.TempDir(), nil)
+	defer DB.Close()
+
+	if err := DB.Put(testKey(1), testValue(1), nil); err != nil {
+		t.Fatal(err)
+	}
+	checkRead(t, DB, testKey(1), testValue(1))
+
+	// newest version wins
+	if err := DB.Put(testKey(1), testValue(2), nil); err != nil {
+		t.Fatal(err)
+	}
+	checkRead(t, DB, testKey(1), testValue(2))
+
+	if err := DB.Delete(testKey(1), nil); err != nil {
+		t.Fatal(err)
+	}
+	checkRead(t, DB, testKey(1), nil)
+	checkRead(t, DB, testKey(2), nil)
+
+	if err := DB.Put(nil, testValue(1), nil); err != ErrEmptyKey {
+		t.Errorf("Expected ErrEmptyKey, got %v", err)
+	}
+	if err := DB.Put(make([]byte, MaxKeySize+1), nil, nil); err != ErrKeyTooLarge {
+		t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	DB := openTestDB(t, dir, nil)
+	for i := range 100 {
+		if err := DB.Put(testKey(i), testValue(i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	DB.Delete(testKey(7), nil)
+	if err := DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.Put(testKey(1), testValue(1), nil); err != ErrDBClosed {
+		t.Errorf("Expected ErrDBClosed, got %v", err)
+	}
+
+	// unflushed writes come back from the WAL
+	DB = openTestDB(t, dir, nil)
+	defer DB.Close()
+	for i := range 100 {
+		want := testValue(i)
+		if i == 7 {
+			want = nil
+		}
+		checkRead(t, DB, testKey(i), want)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	dir := t.TempDir()
+	DB := openTestDB(t, dir, smallOptions())
+	for i := range 500 {
+		if err := DB.Put(testKey(i), testValue(i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	DB.Delete(testKey(7), nil)
+	waitFlushed(t, DB)
+	if tableCount(DB) == 0 {
+		t.Fatal("Expected flushed tables")
+	}
+	check := func() {
+		for i := range 500 {
+			want := testValue(i)
+			if i == 7 {
+				want = nil
+			}
+			checkRead(t, DB, testKey(i), want)
+		}
+	}
+	check()
+
+	if err := DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	DB = openTestDB(t, dir, smallOptions())
+	defer DB.Close()
+	check()
+}
+
+func TestBackgroundError(t *testing.T) {
+	DB := openTestDB(t, t.TempDir(), smallOptions())
+
+	// every flush fails to log its table
+	DB.manifest.page.Close()
+	var err error
+	for i := 0; i < 10000 && err == nil; i++ {
+		err = DB.Put(testKey(i), testValue(i), nil)
+		if err == nil && i%100 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if err == nil {
+		t.Fatal("Expected writes to fail after a failed flush")
+	}
+	bgErr := DB.backgroundError()
+	if bgErr == nil || !errors.Is(err, bgErr) {
+		t.Fatalf("Expected background error, got %v", err)
+	}
+	if err := DB.Put(testKey(0), nil, nil); err != bgErr {
+		t.Errorf("Expected %v, got %v", bgErr, err)
+	}
+	// written data is still readable
+	checkRead(t, DB, testKey(0), testValue(0))
+	if err := DB.Close(); !errors.Is(err, bgErr) {
+		t.Errorf("Expected Close to return %v, got %v", bgErr, err)
+	}
+}
+
+func TestOpenSkipsFlushedLogs(t *testing.T) {
+	dir := t.TempDir()
+	opts := smallOptions()
+	DB := openTestDB(t, dir, opts)
+	for i := range 200 {
+		if err := DB.Put(testKey(i), testValue(i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFlushed(t, DB)
+	if err := DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, _, state, err := recoverManifest(dir, opts.withDefaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logNum := state.logNum
+	if logNum == 0 {
+		t.Fatal("Expected flushed log number in the manifest")
+	}
+
+	// flushed log left behind by a crash during removal
+	stale := walName(dir, logNum)
+	wal, err := NewWal(stale, 0644, 4096, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewWriteBatch()
+	b.Put(testKey(0), []byte("stale"))
+	if _, err := wal.Write(batchEntry(b, db.Now())); err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+
+	// files of others are left alone
+	foreign := []string{"notes.txt", DBName + "-notes.wal", filepath.Join("sub", DBName+"-000001.key")}
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	for _, name := range foreign {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	DB = openTestDB(t, dir, opts)
+	defer DB.Close()
+	checkRead(t, DB, testKey(0), testValue(0))
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Expected flushed log to be removed, got %v", err)
+	}
+	for _, name := range foreign {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected %s to be kept, got %v", name, err)
+		}
+	}
+}
+
+// copy files of an open DB as a crash would leave them
+func crashCopy(t *testing.T, dir string) string {
+	t.Helper()
+	dst := t.TempDir()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.IsDir() || e.Name() == LockFile {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dst, e.Name()), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dst
+}
+
+func TestWriteOptions(t *testing.T) {
+	dir := t.TempDir()
+	DB := openTestDB(t, dir, nil)
+	defer DB.Close()
+
+	if err := DB.Put(testKey(1), testValue(1), &WriteOptions{Sync: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.Put(testKey(2), testValue(2), &WriteOptions{DisableWAL: true}); err != nil {
+		t.Fatal(err)
+	}
+	checkRead(t, DB, testKey(2), testValue(2))
+
+	// only logged writes survive a crash
+	crashed := openTestDB(t, crashCopy(t, dir), nil)
+	defer crashed.Close()
+	checkRead(t, crashed, testKey(1), testValue(1))
+	checkRead(t, crashed, testKey(2), nil)
+}
+
+func TestDisableWAL(t *testing.T) {
+	dir := t.TempDir()
+	opts := smallOptions()
+	opts.DisableWAL = true
+	DB := openTestDB(t, dir, opts)
+	DB.Put(testKey(0), testValue(0), nil)
+	for _, wal := range walFiles(t, dir) {
+		if info, err := os.Stat(wal); err != nil || info.Size() != 0 {
+			t.Fatalf("Expected empty log %s, got %v", wal, err)
+		}
+	}
+
+	// flushed writes are durable
+	for i := 1; i < 200; i++ {
+		DB.Put(testKey(i), testValue(i), nil)
+	}
+	waitFlushed(t, DB)
+	DB.Put(testKey(200), testValue(200), nil)
+	if err := DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// writes of the active memtable are lost
+	DB = openTestDB(t, dir, opts)
+	defer DB.Close()
+	flushed := 0
+	for i := range 200 {
+		val, _ := DB.Read(testKey(i), nil)
+		if val == nil {
+			break
+		}
+		flushed++
+	}
+	if flushed == 0 {
+		t.Fatal("Expected flushed writes after reopen")
+	}
+	for i := flushed; i <= 200; i++ {
+		checkRead(t, DB, testKey(i), nil)
+	}
+}
+
+// ts recovered from disk are never handed out again
+// even when the wall clock is behind them after a restart
+func TestClockAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	DB := openTestDB(t, dir, nil)
+	DB.Put(testKey(1), testValue(1), nil)
+	if err := DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// logged by a clock a second ahead
+	// (the clock is shared by the whole process, keep the jump short)
+	future := db.Last() + uint64(time.Second)
+	wal, err := NewWal(walName(dir, 1<<20), 0644, 4096, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewWriteBatch()
+	b.Put(testKey(1), []byte("future"))
+	if _, err := wal.Write(batchEntry(b, future)); err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+
+	DB = openTestDB(t, dir, nil)
+	if err := DB.Put(testKey(1), testValue(2), nil); err != nil {
+		t.Fatal(err)
+	}
+	checkRead(t, DB, testKey(1), testValue(2))
+
+	// clock kept only by the manifest
+	future = db.Last() + uint64(time.Second)
+	if _, err := DB.manifest.page.Write((&versionEdit{lastTs: future}).serialize()); err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	DB = openTestDB(t, dir, nil)
+	defer DB.Close()
+	if ts := db.Now(); ts <= future {
+		t.Errorf("Expected ts after %d, got %d", future, ts)
+	}
+	checkRead(t, DB, testKey(1), testValue(2))
+}
+
+// reads pick no ts. so they leave the clock alone
+func TestReadKeepsClock(t *testing.T) {
+	DB := openTestDB(t, flushedDB(t), smallOptions())
+	defer DB.Close()
+	DB.Put(testKey(1000), testValue(1000), nil)
+
+	last := db.Last()
+	for i := range 100 {
+		DB.Read(testKey(i*10), nil)
+		DB.ReadAt(testKey(i*10), time.Unix(0, int64(last)), nil)
+	}
+	if ts := db.Last(); ts != last {
+		t.Errorf("Expected clock at %d after reads, got %d", last, ts)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := OpenDB(filepath.Join(dir, "missing"), nil); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist without CreateIfMissing, got %v", err)
+	}
+	DB := openTestDB(t, filepath.Join(dir, "db"), &Options{CreateIfMissing: true, ErrorIfExists: true})
+	if _, err := OpenDB(filepath.Join(dir, "db"), nil); err != ErrDBLocked {
+		t.Errorf("Expected ErrDBLocked, got %v", err)
+	}
+	DB.Close()
+	if _, err := OpenDB(filepath.Join(dir, "db"), &Options{ErrorIfExists: true}); err != ErrDBExists {
+		t.Errorf("Expected ErrDBExists, got %v", err)
+	}
+	// failed opens release the lock
+	DB = openTestDB(t, filepath.Join(dir, "db"), nil)
+	DB.Close()
+}
+
+// open files of the process (-1 if unknown)
+func openFiles() int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
+
+func TestOpenFailureCloses(t *testing.T) {
+	dir := t.TempDir()
+	DB := openTestDB(t, dir, smallOptions())
+	for i := range 200 {
+		DB.Put(testKey(i), testValue(i), nil)
+	}
+	waitFlushed(t, DB)
+	DB.Put(testKey(200), testValue(200), nil)
+	if err := DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tableCount(DB) == 0 {
+		t.Fatal("Expected flushed tables")
+	}
+	wals := walFiles(t, dir)
+	info, err := os.Stat(wals[len(wals)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptPage(t, wals[len(wals)-1], uint32(info.Size()/testPageSize-1))
+
+	// replay fails after tables were opened
+	before := openFiles()
+	opts := smallOptions()
+	opts.WalRecovery = AbsoluteConsistency
+	if _, err := OpenDB(dir, opts); err == nil {
+		t.Fatal("Expected open to fail on a corrupted log")
+	}
+	if after := openFiles(); after != before {
+		t.Errorf("Expected %d open files after a failed open, got %d", before, after)
+	}
+
+	DB = openTestDB(t, dir, smallOptions())
+	defer DB.Close()
+	checkRead(t, DB, testKey(0), testValue(0))
+	checkRead(t, DB, testKey(200), nil)
+}
+
+// flip a byte of every page in the value files of dir
+func corruptValues(t *testing.T, dir string) {
+	t.Helper()
+	vals, err := filepath.Glob(filepath.Join(dir, "*"+ValExtension))
+	if err != nil || len(vals) == 0 {
+		t.Fatalf("Expected value files, got %v", err)
+	}
+	for _, name := range vals {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for off := 8; off < len(data); off += 4096 {
+			data[off] ^= 0xFF
+		}
+		if err := os.WriteFile(name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadOptions(t *testing.T) {
+	dir := t.TempDir()
+	DB := openTestDB(t, dir, smallOptions())
+	for i := range 200 {
+		DB.Put(testKey(i), testValue(i), nil)
+	}
+	waitFlushed(t, DB)
+	DB.Close()
+	corruptValues(t, dir)
+
+	DB = openTestDB(t, dir, &Options{MemTableSize: smallOptions().MemTableSize, DisablePageCache: true})
+	defer DB.Close()
+	snap := DB.GetSnapshot()
+	defer snap.Release()
+	txn, err := DB.BeginTxn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Rollback()
+	now := time.Unix(0, int64(db.Last()))
+
+	reads := map[string]func(key []byte, opts *ReadOptions) ([]byte, error){
+		"Read": DB.Read,
+		"ReadAt": func(key []byte, opts *ReadOptions) ([]byte, error) {
+			return DB.ReadAt(key, now, opts)
+		},
+		"Snapshot.Read": snap.Read,
+		"Txn.Get":       txn.Get,
+		"NewIterator": func(key []byte, opts *ReadOptions) ([]byte, error) {
+			it := DB.NewIterator(key, nil, opts)
+			defer it.Close()
+			return it.Value(), it.Error()
+		},
+		"Snapshot.NewIterator": func(key []byte, opts *ReadOptions) ([]byte, error) {
+			it := snap.NewIterator(key, nil, opts)
+			defer it.Close()
+			return it.Value(), it.Error()
+		},
+	}
+	for name, read := range reads {
+		corrupted := 0
+		for i := range 200 {
+			_, err := read(testKey(i), nil)
+			var corrupt *page.ErrCorruption
+			if err != nil && !errors.As(err, &corrupt) {
+				t.Fatalf("%s: expected ErrCorruption, got %v", name, err)
+			}
+			if err == nil {
+				continue
+			}
+			corrupted++
+
+			// zero options verify too
+			if _, err := read(testKey(i), &ReadOptions{}); !errors.As(err, &corrupt) {
+				t.Fatalf("%s: expected ErrCorruption, got %v", name, err)
+			}
+			// unverified reads return the damaged value
+			if _, err := read(testKey(i), &ReadOptions{SkipChecksums: true}); err != nil {
+				t.Fatalf("%s: expected unverified read, got %v", name, err)
+			}
+		}
+		if corrupted == 0 {
+			t.Errorf("%s: expected corrupted reads", name)
+		}
+	}
+}
+
+// writers wait for flushes instead of piling up memtables
+func TestWriteStall(t *testing.T) {
+	opts := smallOptions()
+	opts.MaxImmutableMemtables = 1
+	DB := openTestDB(t, t.TempDir(), opts)
+	defer DB.Close()
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	var most int
+	go func() {
+		defer close(done)
+		for {
+			DB.mu.RLock()
+			most = max(most, len(DB.memtables))
+			DB.mu.RUnlock()
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 300 {
+				if err := DB.Put(testKey(w*1000+i), testValue(i), nil); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-done
+	if most > 2 {
+		t.Errorf("Expected at most 1 immutable memtable, got %d", most-1)
+	}
+	for w := range 4 {
+		checkRead(t, DB, testKey(w*1000+299), testValue(299))
+	}
+}
+
+// a stalled writer fails once flushing fails
+func TestWriteStallError(t *testing.T) {
+	opts := smallOptions()
+	opts.MaxImmutableMemtables = 1
+	DB := openTestDB(t, t.TempDir(), opts)
+	DB.manifest.page.Close()
+
+	errC := make(chan error, 1)
+	go func() {
+		var err error
+		for i := 0; err == nil; i++ {
+			err = DB.Put(testKey(i), testValue(i), nil)
+		}
+		errC <- err
+	}()
+	select {
+	case err := <-errC:
+		if err != DB.backgroundError() {
+			t.Errorf("Expected background error, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Stalled writer not woken by the failed flush")
+	}
+	DB.Close()
+}
@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package irisdb
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// lockDir only creates the LOCK file here
+// no flock so the directory is not guarded against other processes
+func lockDir(dir string, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(filepath.Join(dir, LockFile), os.O_CREATE|os.O_RDWR, perm)
+}
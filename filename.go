@@ -0,0 +1,47 @@
+package irisdb
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// every file in the db directory is named by a number
+// from the same allocator. so names never collide and
+// a smaller number always means an older file
+
+func tableName(dir string, fileNum uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%06d", DBName, fileNum))
+}
+
+func walName(dir string, fileNum uint64) string {
+	return tableName(dir, fileNum) + WalExtension
+}
+
+func manifestName(dir string, fileNum uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%06d", ManifestPrefix, fileNum))
+}
+
+// return number of a db file (table, wal or manifest)
+func parseFileNum(path string) (uint64, bool) {
+	name := filepath.Base(path)
+	switch {
+	case strings.HasPrefix(name, ManifestPrefix):
+		name = strings.TrimPrefix(name, ManifestPrefix)
+	case strings.HasPrefix(name, DBName+"-"):
+		name = strings.TrimSuffix(strings.TrimPrefix(name, DBName+"-"), filepath.Ext(name))
+	default:
+		return 0, false
+	}
+	num, err := strconv.ParseUint(name, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return num, true
+}
+
+// allocate next file number
+func (DB *IrisDB) newFileNum() uint64 {
+	return DB.nextFile.Add(1)
+}
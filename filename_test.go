@@ -0,0 +1,62 @@
+package irisdb
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseFileNum(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		tableName(dir, 7) + KeyExtension,
+		tableName(dir, 7) + ValExtension,
+		walName(dir, 7),
+		manifestName(dir, 7),
+	} {
+		if num, ok := parseFileNum(name); !ok || num != 7 {
+			t.Errorf("parseFileNum(%s) = %d, %v", name, num, ok)
+		}
+	}
+	for _, name := range []string{CurrentFile, OptionsFile, LockFile, DBName + "-x.wal", "other-000007.wal"} {
+		if _, ok := parseFileNum(name); ok {
+			t.Errorf("Expected %s to be no db file", name)
+		}
+	}
+}
+
+// numbers keep growing across reopens
+// so a new file never reuses the name of an old one
+func TestFileNumbers(t *testing.T) {
+	dir := t.TempDir()
+	maxNum := func() uint64 {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n uint64
+		for _, e := range entries {
+			if num, ok := parseFileNum(e.Name()); ok {
+				n = max(n, num)
+			}
+		}
+		return n
+	}
+
+	var last uint64
+	for round := range 3 {
+		DB := openTestDB(t, dir, smallOptions())
+		if num := DB.nextFile.Load(); num <= last {
+			t.Fatalf("round %d: next file %d not above %d", round, num, last)
+		}
+		for i := range 100 {
+			if err := DB.Put(testKey(i), testValue(round), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		waitFlushed(t, DB)
+		if err := DB.Close(); err != nil {
+			t.Fatal(err)
+		}
+		last = maxNum()
+	}
+}
@@ -1,18 +1,19 @@
 package filter
 
 import (
-	"bytes"
-	"encoding/gob"
+	"encoding/binary"
 	"errors"
 	"math"
 
 	"github.com/cespare/xxhash/v2"
 )
 
+var ErrInvalidFilter = errors.New("invalid serialized bloom filter")
+
 type Bloomfilter struct {
 	bitSet []uint64
-	hashes []uint64
-	Size   uint32
+	k      uint32 // number of hash functions
+	Size   uint32 // number of words in bitSet
 }
 
 func NewBloomFilter(n uint32, fp float64) (*Bloomfilter, error) {
@@ -34,26 +35,25 @@ func NewBloomFilter(n uint32, fp float64) (*Bloomfilter, error) {
 	return &Bloomfilter{
 		Size:   sz,
 		bitSet: make([]uint64, sz),
-		hashes: make([]uint64, k),
+		k:      k,
 	}, nil
 }
 
-func (bf *Bloomfilter) getHashes(data []byte) {
-	h1 := xxhash.Sum64(data)
-
-	// Mock Way to generate another hash
-	h2 := h1 >> 32
-
+// return bit position of the i-th hash
+// (no shared state so Contains is safe for concurrent readers)
+func (bf *Bloomfilter) position(h1, h2 uint64, i uint32) uint64 {
 	// Double hashing technique: h_i(x) = h1(x) + i*h2(x)
-	for i := 0; i < len(bf.hashes); i++ {
-		hx := h1 + uint64(i)*h2
-		bf.hashes[i] = hx % uint64(bf.Size)
-	}
+	hx := h1 + uint64(i)*h2
+	return hx % (uint64(bf.Size) * 64)
 }
 
 func (bf *Bloomfilter) Add(data []byte) {
-	bf.getHashes(data)
-	for _, pos := range bf.hashes {
+	h1 := xxhash.Sum64(data)
+
+	// Mock Way to generate another hash
+	h2 := h1 >> 32
+	for i := range bf.k {
+		pos := bf.position(h1, h2, i)
 		arrayPos := pos / 64
 		bitPos := pos % 64
 		bf.bitSet[arrayPos] |= 1 << bitPos
@@ -61,8 +61,10 @@ func (bf *Bloomfilter) Add(data []byte) {
 }
 
 func (bf *Bloomfilter) Contains(data []byte) bool {
-	bf.getHashes(data)
-	for _, pos := range bf.hashes {
+	h1 := xxhash.Sum64(data)
+	h2 := h1 >> 32
+	for i := range bf.k {
+		pos := bf.position(h1, h2, i)
 		arrayPos := pos / 64
 		bitPos := pos % 64
 		if (bf.bitSet[arrayPos] & (1 << bitPos)) == 0 {
@@ -72,16 +74,36 @@ func (bf *Bloomfilter) Contains(data []byte) bool {
 	return true // maybe
 }
 
-func BytesTOSTruct(buf bytes.Buffer) *Bloomfilter {
-	dec := gob.NewDecoder(&buf)
+func (bf *Bloomfilter) Serialize() []byte {
+
+	/*
+		FILTER LAYOUT
+		-------------------------------------
+		| K(4) | Size(4) | bitSet(Size * 8) |
+		-------------------------------------
+	*/
 
-	var bf *Bloomfilter
-	dec.Decode(bf)
-	return bf
+	data := make([]byte, 8, 8+len(bf.bitSet)*8)
+	binary.BigEndian.PutUint32(data[0:4], bf.k)
+	binary.BigEndian.PutUint32(data[4:8], bf.Size)
+	for _, w := range bf.bitSet {
+		data = binary.BigEndian.AppendUint64(data, w)
+	}
+	return data
 }
 
-func (bf *Bloomfilter) StructToBytes(buf bytes.Buffer) error {
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(&bf)
-	return err
+func Deserialize(data []byte) (*Bloomfilter, error) {
+	if len(data) < 8 {
+		return nil, ErrInvalidFilter
+	}
+	k := binary.BigEndian.Uint32(data[0:4])
+	sz := binary.BigEndian.Uint32(data[4:8])
+	if sz == 0 || uint64(len(data)-8) != uint64(sz)*8 {
+		return nil, ErrInvalidFilter
+	}
+	bitSet := make([]uint64, sz)
+	for i := range bitSet {
+		bitSet[i] = binary.BigEndian.Uint64(data[8+i*8:])
+	}
+	return &Bloomfilter{bitSet: bitSet, k: k, Size: sz}, nil
 }
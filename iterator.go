@@ -0,0 +1,270 @@
+package irisdb
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/alimx07/IrisDB/db"
+	"github.com/alimx07/IrisDB/skiplist"
+)
+
+// source of versions for the merging Iterator
+// keys are with ts and sorted by db.CompareKeys
+type internalIterator interface {
+	Valid() bool
+	Key() []byte
+	Value() ([]byte, error)
+	Next()
+	Err() error
+}
+
+// memtable versions with ts <= snapshot ts
+type memIterator struct {
+	it *skiplist.Iterator
+}
+
+func newMemIterator(mem *skiplist.SkipList, lower []byte, ts uint64) *memIterator {
+	it := skiplist.NewiteratorAt(mem, ts)
+	if lower == nil {
+		it.SeekToStart()
+	} else {
+		it.Seek(db.NewKeyAt(lower, math.MaxUint64))
+	}
+	return &memIterator{it: it}
+}
+
+func (mi *memIterator) Valid() bool            { return mi.it.Valid() }
+func (mi *memIterator) Key() []byte            { return mi.it.GetKey() }
+func (mi *memIterator) Value() ([]byte, error) { return mi.it.Get(), nil }
+func (mi *memIterator) Next()                  { mi.it.Next() }
+func (mi *memIterator) Err() error             { return nil }
+
+// table versions with ts <= snapshot ts
+// values are only read when asked for
+type tableIterator struct {
+	sst *SSTABLE
+	it  *sstIterator
+	ts  uint64
+}
+
+func newTableIterator(sst *SSTABLE, lower []byte, ts uint64, verify bool) *tableIterator {
+	ti := &tableIterator{sst: sst, it: &sstIterator{sst: sst, verify: verify}, ts: ts}
+	if lower == nil {
+		ti.it.loadBlock()
+	} else {
+		ti.it.seek(db.NewKeyAt(lower, math.MaxUint64))
+	}
+	ti.skipNewer()
+	return ti
+}
+
+// skip versions written after the snapshot
+func (ti *tableIterator) skipNewer() {
+	for ti.it.Valid() && db.GetTsAsUint64(ti.it.Key()[ValPtrSize:]) > ti.ts {
+		ti.it.Next()
+	}
+}
+
+func (ti *tableIterator) Valid() bool { return ti.it.Valid() }
+func (ti *tableIterator) Key() []byte { return ti.it.Key()[ValPtrSize:] }
+func (ti *tableIterator) Err() error  { return ti.it.err }
+
+func (ti *tableIterator) Value() ([]byte, error) {
+	read := ti.sst.vals.Read
+	if !ti.it.verify {
+		read = ti.sst.vals.ReadUnverified
+	}
+	val, _, err := read(binary.BigEndian.Uint32(ti.it.Key()[:ValPtrSize]))
+	return val, err
+}
+
+func (ti *tableIterator) Next() {
+	ti.it.Next()
+	ti.skipNewer()
+}
+
+type mergeItem struct {
+	it internalIterator
+	id int // source priority (lower is newer)
+}
+
+type mergeHeap []*mergeItem
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	cmp := db.CompareKeys(h[i].it.Key(), h[j].it.Key())
+	if cmp == 0 {
+		return h[i].id < h[j].id
+	}
+	return cmp < 0
+}
+
+func (h mergeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *mergeHeap) Push(x any) {
+	*h = append(*h, x.(*mergeItem))
+}
+
+func (h *mergeHeap) Pop() any {
+	n := len(*h)
+	item := (*h)[n-1]
+	(*h)[n-1] = nil
+	*h = (*h)[:n-1]
+	return item
+}
+
+/*
+Iterator walk keys in [lower, upper) in order over the memtables and all table levels
+
+Only the newest version of every key is visible and deleted keys are hidden.
+The view is fixed at creation time. Close must be called to release the tables.
+*/
+type Iterator struct {
+	heap     mergeHeap
+	mems     []*memIterator
+	sstables [][]*SSTABLE
+	upper    []byte
+	key      []byte
+	val      []byte
+	valid    bool
+	err      error
+}
+
+// NewIterator over [lower, upper). nil bound means unbounded
+func (DB *IrisDB) NewIterator(lower, upper []byte, opts *ReadOptions) *Iterator {
+	// like a snapshot. no write is half applied while the ts is taken
+	DB.commitMu.Lock()
+	ts := db.Now()
+	DB.commitMu.Unlock()
+	return DB.newIterator(lower, upper, ts, opts)
+}
+
+// NewIteratorAt over [lower, upper) as the DB was at ts
+// every key shows its newest version written at or before ts
+// (Error is ErrTsCompacted if compaction dropped versions after ts)
+func (DB *IrisDB) NewIteratorAt(lower, upper []byte, ts time.Time, opts *ReadOptions) *Iterator {
+	if ts.UnixNano() < 0 {
+		return &Iterator{}
+	}
+	if uint64(ts.UnixNano()) < DB.horizon.Load() {
+		return &Iterator{err: ErrTsCompacted}
+	}
+	return DB.newIterator(lower, upper, uint64(ts.UnixNano()), opts)
+}
+
+func (DB *IrisDB) newIterator(lower, upper []byte, ts uint64, opts *ReadOptions) *Iterator {
+	if opts == nil {
+		opts = DefaultReadOptions()
+	}
+	if len(lower) == 0 {
+		lower = nil
+	}
+	memtables, sstables := DB.acquire()
+	it := &Iterator{sstables: sstables, upper: upper}
+
+	// sources ordered from newest to oldest
+	var sources []internalIterator
+	for _, mem := range memtables {
+		mi := newMemIterator(mem, lower, ts)
+		it.mems = append(it.mems, mi)
+		sources = append(sources, mi)
+	}
+	for _, lv := range sstables {
+		for _, sst := range lv {
+			sources = append(sources, newTableIterator(sst, lower, ts, !opts.SkipChecksums))
+		}
+	}
+	for id, src := range sources {
+		if src.Err() != nil {
+			it.err = src.Err()
+			return it
+		}
+		if src.Valid() {
+			it.heap = append(it.heap, &mergeItem{it: src, id: id})
+		}
+	}
+	heap.Init(&it.heap)
+	it.findNext()
+	return it
+}
+
+// move to the newest visible version of the next key
+func (it *Iterator) findNext() {
+	it.valid = false
+	for it.err == nil && it.heap.Len() > 0 {
+		top := it.heap[0].it
+		raw := db.RawKey(top.Key())
+		if it.upper != nil && bytes.Compare(raw, it.upper) >= 0 {
+			it.heap = it.heap[:0]
+			return
+		}
+		val, err := top.Value()
+		if err != nil {
+			it.err = err
+			return
+		}
+		it.key = append(it.key[:0], raw...)
+		it.val = append(it.val[:0], val...)
+
+		// older versions of the same key are hidden
+		for it.heap.Len() > 0 && bytes.Equal(db.RawKey(it.heap[0].it.Key()), it.key) {
+			item := it.heap[0]
+			item.it.Next()
+			if err := item.it.Err(); err != nil {
+				it.err = err
+				return
+			}
+			if item.it.Valid() {
+				heap.Fix(&it.heap, 0)
+			} else {
+				heap.Pop(&it.heap)
+			}
+		}
+		if !bytes.Equal(it.val, TOMPOSTONE) {
+			it.valid = true
+			return
+		}
+	}
+}
+
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// current key. valid until next call of Next
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// current value. valid until next call of Next
+func (it *Iterator) Value() []byte {
+	return it.val
+}
+
+func (it *Iterator) Next() {
+	it.findNext()
+}
+
+// Error return first error faced while iterating
+func (it *Iterator) Error() error {
+	return it.err
+}
+
+// Close release memtables and tables held by the iterator
+func (it *Iterator) Close() error {
+	for _, mi := range it.mems {
+		mi.it.Close()
+	}
+	it.mems = nil
+	unrefTables(it.sstables)
+	it.sstables = nil
+	it.valid = false
+	it.heap = nil
+	return it.err
+}
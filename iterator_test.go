@@ -0,0 +1,98 @@
+package irisdb
+
+import "testing"
+
+// keys and values of [lower, upper) in iteration order
+func scan(t *testing.T, DB *IrisDB, lower, upper []byte) ([]string, []string) {
+	t.Helper()
+	it := DB.NewIterator(lower, upper, nil)
+	defer it.Close()
+	var keys, vals []string
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+		vals = append(vals, string(it.Value()))
+	}
+	if err := it.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return keys, vals
+}
+
+func TestIterator(t *testing.T) {
+	DB := openTestDB(t, t.TempDir(), compactOptions())
+	defer DB.Close()
+
+	// oldest versions in deeper levels
+	const n = 300
+	want := make([]string, n) // value of key i ("" if missing)
+	for i := range n {
+		DB.Put(testKey(i), testValue(i), nil)
+		want[i] = string(testValue(i))
+	}
+	waitCompacted(t, DB)
+	DB.mu.RLock()
+	deeper := len(DB.sstables[1])
+	DB.mu.RUnlock()
+	if deeper == 0 {
+		t.Fatal("Expected tables below level 0")
+	}
+
+	// newer versions and tombstones in level 0
+	for i := 0; i < n; i += 3 {
+		DB.Put(testKey(i), []byte("l0"), nil)
+		want[i] = "l0"
+	}
+	for i := 1; i < n; i += 7 {
+		DB.Delete(testKey(i), nil)
+		want[i] = ""
+	}
+	waitFlushed(t, DB)
+
+	// newest in the memtable
+	for i := 0; i < n; i += 5 {
+		DB.Put(testKey(i), []byte("mem"), nil)
+		want[i] = "mem"
+	}
+	DB.Delete(testKey(3), nil)
+	want[3] = ""
+
+	check := func(lower, upper, from, to int) {
+		t.Helper()
+		var lo, up []byte
+		if lower >= 0 {
+			lo = testKey(lower)
+		}
+		if upper >= 0 {
+			up = testKey(upper)
+		}
+		keys, vals := scan(t, DB, lo, up)
+		j := 0
+		for i := from; i < to; i++ {
+			if want[i] == "" {
+				continue
+			}
+			if j >= len(keys) || keys[j] != string(testKey(i)) || vals[j] != want[i] {
+				t.Fatalf("[%d, %d) entry %d: expected %s=%s, got %v", lower, upper, j, testKey(i), want[i], keys[j:min(j+1, len(keys))])
+			}
+			j++
+		}
+		if j != len(keys) {
+			t.Fatalf("[%d, %d): expected %d keys, got %d", lower, upper, j, len(keys))
+		}
+	}
+	check(-1, -1, 0, n)
+
+	// lower is inclusive and upper exclusive
+	check(10, 20, 10, 20)
+	check(-1, 20, 0, 20)
+	check(290, -1, 290, n)
+
+	// bounds on deleted keys
+	check(1, 8, 1, 8)
+	check(3, 3, 3, 3)
+	check(20, 10, 20, 20)
+	keys, _ := scan(t, DB, []byte("z"), nil)
+	if len(keys) != 0 {
+		t.Errorf("Expected no keys after the last one, got %d", len(keys))
+	}
+}
@@ -0,0 +1,125 @@
+package irisdb
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+var (
+	ErrLockTimeout = errors.New("lock wait timed out")
+	ErrDeadlock    = errors.New("deadlock detected")
+)
+
+// exclusive lock of a single key
+type keyLock struct {
+	owner    uint64        // txn id
+	released chan struct{} // closed on unlock
+}
+
+type lockStripe struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+// lockManager is the lock table of pessimistic txns
+// keys are spread over stripes so unrelated keys rarely contend
+//
+// every waiting txn waits for exactly one owner so the
+// wait-for graph is a set of chains. a new wait edge
+// that closes a chain into a cycle is a deadlock
+type lockManager struct {
+	stripes []lockStripe
+	graphMu sync.Mutex
+	waitFor map[uint64]uint64 // waiting txn -> owner it waits for
+}
+
+func newLockManager(n int) *lockManager {
+	lm := &lockManager{
+		stripes: make([]lockStripe, n),
+		waitFor: make(map[uint64]uint64),
+	}
+	for i := range lm.stripes {
+		lm.stripes[i].locks = make(map[string]*keyLock)
+	}
+	return lm
+}
+
+func (lm *lockManager) stripe(key string) *lockStripe {
+	return &lm.stripes[xxhash.Sum64String(key)%uint64(len(lm.stripes))]
+}
+
+// lock key for txn (no-op if txn already holds it)
+// fails with ErrDeadlock or ErrLockTimeout without taking the lock
+func (lm *lockManager) lock(txn uint64, key string, timeout time.Duration) error {
+	s := lm.stripe(key)
+	var timer *time.Timer
+	for {
+		s.mu.Lock()
+		l, ok := s.locks[key]
+		if !ok {
+			s.locks[key] = &keyLock{owner: txn, released: make(chan struct{})}
+			s.mu.Unlock()
+			return nil
+		}
+		if l.owner == txn {
+			s.mu.Unlock()
+			return nil
+		}
+
+		// edge is added while the owner can't release
+		// so it never points to a finished txn we can't see
+		lm.graphMu.Lock()
+		if lm.waits(l.owner, txn) {
+			lm.graphMu.Unlock()
+			s.mu.Unlock()
+			return ErrDeadlock
+		}
+		lm.waitFor[txn] = l.owner
+		lm.graphMu.Unlock()
+		s.mu.Unlock()
+
+		if timer == nil {
+			timer = time.NewTimer(timeout)
+			defer timer.Stop()
+		}
+		select {
+		case <-l.released:
+			lm.clearWait(txn)
+		case <-timer.C:
+			lm.clearWait(txn)
+			return ErrLockTimeout
+		}
+	}
+}
+
+// whether from waits (directly or through others) for to
+func (lm *lockManager) waits(from, to uint64) bool {
+	for curr, ok := from, true; ok; curr, ok = lm.waitFor[curr] {
+		if curr == to {
+			return true
+		}
+	}
+	return false
+}
+
+func (lm *lockManager) clearWait(txn uint64) {
+	lm.graphMu.Lock()
+	delete(lm.waitFor, txn)
+	lm.graphMu.Unlock()
+}
+
+// unlock keys held by txn and wake their waiters
+func (lm *lockManager) unlock(txn uint64, keys map[string]struct{}) {
+	for key := range keys {
+		s := lm.stripe(key)
+		s.mu.Lock()
+		if l, ok := s.locks[key]; ok && l.owner == txn {
+			delete(s.locks, key)
+			close(l.released)
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,114 @@
+package irisdb
+
+import (
+	"testing"
+	"time"
+)
+
+// wait until txn waits for a lock
+func waitBlocked(t *testing.T, DB *IrisDB, txn *Txn) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		DB.locks.graphMu.Lock()
+		_, ok := DB.locks.waitFor[txn.id]
+		DB.locks.graphMu.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("txn never blocked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	DB := openTestDB(t, t.TempDir(), &Options{LockTimeout: 20 * time.Millisecond})
+	defer DB.Close()
+
+	t1, _ := DB.BeginPessimisticTxn()
+	t2, _ := DB.BeginPessimisticTxn()
+	if err := t1.Put(testKey(1), testValue(1)); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := t2.Put(testKey(1), testValue(2)); err != ErrLockTimeout {
+		t.Fatalf("Expected ErrLockTimeout, got %v", err)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("lock wait returned before the timeout")
+	}
+	if _, err := t2.GetForUpdate(testKey(1), nil); err != ErrLockTimeout {
+		t.Fatalf("Expected ErrLockTimeout, got %v", err)
+	}
+	t2.Rollback()
+	if err := t1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeadlock(t *testing.T) {
+	DB := openTestDB(t, t.TempDir(), nil)
+	defer DB.Close()
+
+	t1, _ := DB.BeginPessimisticTxn()
+	t2, _ := DB.BeginPessimisticTxn()
+	t1.Put(testKey(1), testValue(1))
+	t2.Put(testKey(2), testValue(2))
+
+	done := make(chan error)
+	go func() { done <- t1.Put(testKey(2), testValue(1)) }()
+	waitBlocked(t, DB, t1)
+
+	// t2 -> t1 -> t2
+	if err := t2.Put(testKey(1), testValue(2)); err != ErrDeadlock {
+		t.Fatalf("Expected ErrDeadlock, got %v", err)
+	}
+	t2.Rollback()
+	if err := <-done; err != nil {
+		t.Fatalf("Expected t1 to get the lock, got %v", err)
+	}
+	if err := t1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	checkRead(t, DB, testKey(1), testValue(1))
+	checkRead(t, DB, testKey(2), testValue(1))
+}
+
+func TestLockRelease(t *testing.T) {
+	DB := openTestDB(t, t.TempDir(), nil)
+	defer DB.Close()
+
+	for _, commit := range []bool{true, false} {
+		t1, _ := DB.BeginPessimisticTxn()
+		t2, _ := DB.BeginPessimisticTxn()
+		if _, err := t1.GetForUpdate(testKey(1), nil); err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan error)
+		go func() { done <- t2.Put(testKey(1), testValue(2)) }()
+		waitBlocked(t, DB, t2)
+		if commit {
+			t1.Commit()
+		} else {
+			t1.Rollback()
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("commit %v: Expected the lock after release, got %v", commit, err)
+		}
+		t2.Rollback()
+	}
+
+	// nothing is left locked
+	for i := range DB.locks.stripes {
+		s := &DB.locks.stripes[i]
+		s.mu.Lock()
+		n := len(s.locks)
+		s.mu.Unlock()
+		if n != 0 {
+			t.Fatalf("Expected empty lock table, got %d locks", n)
+		}
+	}
+}
@@ -2,15 +2,19 @@ package irisdb
 
 import (
 	"bytes"
+	"cmp"
 	"container/heap"
+	"container/list"
 	"encoding/binary"
 	"errors"
-	"fmt"
-	"io/fs"
+	"math"
 	"os"
 	"path/filepath"
-	"strconv"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/alimx07/IrisDB/db"
@@ -21,182 +25,1100 @@ import (
 )
 
 type SSTABLE struct {
-	keys   *page.Page
-	vals   *page.Page
-	filter *filter.Bloomfilter
-	index  *IndexBlock
-	size   uint64
+	name     string // path of table without extension
+	fileNum  uint64
+	keys     *page.Page
+	vals     *page.Page
+	filter   *filter.Bloomfilter
+	index    *IndexBlock
+	size     uint64
+	block    *Block // block under construction
+	count    uint32 // number of keys written
+	smallest []byte
+	largest  []byte
+	refs     atomic.Int32 // one for the DB layout + one per reader
+	obsolete atomic.Bool  // compacted away. delete files on last unref
+	opts     *Options
 }
 
+var (
+	ErrEmptyKey      = errors.New("key must not be empty")
+	ErrKeyTooLarge   = errors.New("key exceeds max key size")
+	ErrCorruptSST    = errors.New("sstable data is corrupted")
+	ErrFormatVersion = errors.New("unsupported on-disk format version")
+	ErrDBClosed      = errors.New("db is closed")
+	ErrDBLocked      = errors.New("db is used by another process")
+	ErrDBExists      = errors.New("db already exists")
+	ErrBatchTooLarge = errors.New("batch exceeds memtable size")
+	ErrTsCompacted   = errors.New("versions at ts were dropped by compaction")
+)
+
 type IrisDB struct {
+	path      string
+	opts      *Options
+	lock      *os.File     // flock of the LOCK file
+	mu        sync.RWMutex // guards memtables, wal and sstables
 	sstables  [][]*SSTABLE
-	memtables []*skiplist.SkipList
-	wal       []*WAL
+	memtables []*skiplist.SkipList // memtables[0] is the active one, rest are immutable (newest first)
+	wal       [][]*WAL             // wal[i] are log segments whose newest records are in memtables[i] (oldest first)
+	flushC    chan struct{}
+	compactC  chan struct{}
+	close     chan struct{}
+	wg        sync.WaitGroup
+	isClosed  atomic.Bool
+	flushed   *sync.Cond // on mu. signaled when a memtable is flushed (or writes must stop)
+	bgMu      sync.Mutex
+	bgErr     error // first failure of flush or compaction. fails later writes
+
+	snapMu     sync.Mutex
+	snapshots  *list.List   // ts of live snapshots
+	commitMu   sync.RWMutex // held by writes (shared) and txn commits (exclusive)
+	locks      *lockManager
+	recovery   RecoveryReport // dropped wal records of the open
+	walPurged  atomic.Uint64  // updates with ts <= walPurged may be gone from the WAL
+	txnID      atomic.Uint64
+	manifest   *Manifest
+	nextFile   atomic.Uint64 // last allocated file number
+	horizon    atomic.Uint64 // reads before it may miss versions dropped by compaction
+	compactPtr [][]byte      // largest key of last compaction per level
 }
 
-func OpenDB(dbPath string) (*IrisDB, error) {
+// OpenDB opens the DB in dbPath with opts (nil for defaults)
+// the directory stays locked against other opens until Close
+func OpenDB(dbPath string, opts *Options) (_ *IrisDB, err error) {
+	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if opts.DisablePageCache {
+		opts.PageCache = nil
+	} else if opts.PageCache == nil {
+		opts.PageCache = page.NewCache(opts.PageCacheSize)
+	}
+
+	_, err = os.Stat(dbPath)
+	if errors.Is(err, os.ErrNotExist) && opts.CreateIfMissing {
+		err = os.MkdirAll(dbPath, 0755)
+	}
+	if err != nil {
+		return nil, err
+	}
+	lock, err := lockDir(dbPath, opts.Permission)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			lock.Close()
+		}
+	}()
+
+	// a db has CURRENT once it was opened
+	if opts.ErrorIfExists {
+		if _, err := os.Stat(filepath.Join(dbPath, CurrentFile)); err == nil {
+			return nil, ErrDBExists
+		}
+	}
 
-	// db not found
-	if _, err := os.Open(dbPath); err != nil {
+	// files are unreadable with a different format
+	stored, err := readOptions(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.checkCompatible(stored); err != nil {
+		return nil, err
+	}
+	if err := writeOptions(dbPath, opts); err != nil {
 		return nil, err
 	}
-	DB := &IrisDB{}
 
-	var curr, key, val *page.Page
+	DB := &IrisDB{
+		path:       dbPath,
+		opts:       opts,
+		lock:       lock,
+		flushC:     make(chan struct{}, 1),
+		compactC:   make(chan struct{}, 1),
+		close:      make(chan struct{}),
+		compactPtr: make([][]byte, opts.MaxLevels),
+		snapshots:  list.New(),
+		locks:      newLockManager(opts.LockStripes),
+		recovery:   RecoveryReport{Mode: opts.WalRecovery},
+		sstables:   make([][]*SSTABLE, opts.MaxLevels),
+	}
+
+	DB.flushed = sync.NewCond(&DB.mu)
+
+	// a failed open leaves nothing open behind it
+	// (background goroutines are started only once nothing can fail)
+	defer func() {
+		if err != nil {
+			DB.closeFiles()
+		}
+	}()
 
-	sstables := make([][]*SSTABLE, MaxLevels)
+	// committed tables layout
+	oldManifest, metas, state, err := recoverManifest(dbPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[string]bool)
+	for lv, tables := range metas {
+		for _, meta := range tables {
+			sst, err := openSSTABLE(dbPath, meta, opts)
+			if err != nil {
+				return nil, err
+			}
+			DB.sstables[lv] = append(DB.sstables[lv], sst)
+			live[sst.name] = true
+		}
+	}
 
 	// Read Files in the DB
-	err := filepath.WalkDir(dbPath, func(path string, d fs.DirEntry, err error) error {
+	// only names of our own files are touched
+	entries, err := os.ReadDir(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	var wals []string
+	maxFile := state.nextFile
+	for _, entry := range entries {
+		num, ok := parseFileNum(entry.Name())
+		if !ok || entry.IsDir() {
+			continue
+		}
+		maxFile = max(maxFile, num)
+		path := filepath.Join(dbPath, entry.Name())
+		var stale bool
+		switch ext := filepath.Ext(path); {
+		case ext == WalExtension:
+			// logs of flushed memtables whose removal didn't finish
+			stale = num <= state.logNum
+			if !stale {
+				wals = append(wals, path)
+			}
+
+		// tables not in the manifest were never committed
+		// (half written outputs or already compacted inputs)
+		case ext == KeyExtension || ext == ValExtension:
+			stale = !live[strings.TrimSuffix(path, ext)]
+
+		// leftover of an open that crashed before switching CURRENT
+		case strings.HasPrefix(entry.Name(), ManifestPrefix):
+			stale = path != oldManifest
+		}
+		if stale {
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	DB.nextFile.Store(maxFile)
+	DB.horizon.Store(state.horizon)
+
+	// replay older logs first
+	slices.SortFunc(wals, func(a, b string) int {
+		x, _ := parseFileNum(a)
+		y, _ := parseFileNum(b)
+		return cmp.Compare(x, y)
+	})
+	oldest, err := DB.replayWal(wals)
+	if err != nil {
+		return nil, err
+	}
+
+	// logs of flushed tables are gone. only updates
+	// from the oldest live log on can be tailed
+	if slices.ContainsFunc(DB.sstables, func(lv []*SSTABLE) bool { return len(lv) > 0 }) {
+		DB.walPurged.Store(oldest - 1)
+	}
+
+	// level-0 newest first. other levels by key
+	slices.SortFunc(DB.sstables[0], func(a, b *SSTABLE) int {
+		return cmp.Compare(b.fileNum, a.fileNum)
+	})
+	for _, lv := range DB.sstables[1:] {
+		sortLevel(lv)
+	}
+
+	// start new manifest from the recovered layout
+	fileNum := DB.newFileNum()
+	state.nextFile = fileNum
+	DB.manifest, err = createManifest(dbPath, fileNum, metas, state, opts)
+	if err != nil {
+		return nil, err
+	}
+	if oldManifest != "" {
+		os.Remove(oldManifest)
+	}
+
+	// fresh memtable and log for new writes
+	// replayed ones stay behind it as read only until flushed
+	if err := DB.newMemtable(); err != nil {
+		return nil, err
+	}
+	DB.wg.Add(2)
+	go DB.flushProcess()
+	go DB.compact()
+	DB.scheduleFlush()
+	DB.scheduleCompaction()
+	return DB, err
+}
+
+// rebuild memtables of unflushed log segments
+// paths are sorted oldest first
+// returns ts of the oldest replayed record (now if none)
+func (DB *IrisDB) replayWal(paths []string) (uint64, error) {
+	oldest := db.Now()
+	if len(paths) == 0 {
+		return oldest, nil
+	}
+	mems := []*skiplist.SkipList{skiplist.NewSkipList(uint32(DB.opts.MemTableSize))}
+	wals := make([][]*WAL, 1)
+	for i, path := range paths {
+		wal, err := DB.newWal(path)
 		if err != nil {
-			return nil
+			return 0, err
 		}
-		if d.IsDir() {
-			return nil
+
+		// older segments were synced whole before the next one
+		// was started. only the newest can have a torn tail
+		mode := DB.opts.WalRecovery
+		if mode == TolerateCorruptedTail && i < len(paths)-1 {
+			mode = AbsoluteConsistency
+		}
+		dropped, err := wal.Replay(mode, func(log *LogEntry) error {
+			oldest = min(oldest, log.ts())
+			db.Observe(log.ts())
+			insert := func(mem *skiplist.SkipList) error {
+				if log.Op != OpBatch {
+					return mem.Insert(log.Key, db.NewValue(log.Value))
+				}
+				b, ts, err := batchFromEntry(log)
+				if err != nil {
+					return err
+				}
+				return b.apply(mem, ts)
+			}
+			err := insert(mems[0])
+
+			// heights are random so replay may need more room
+			// than the original memtable had
+			if err == skiplist.ErrSizeFull {
+				mems = append([]*skiplist.SkipList{skiplist.NewSkipList(uint32(DB.opts.MemTableSize))}, mems...)
+				wals = append([][]*WAL{nil}, wals...)
+				err = insert(mems[0])
+			}
+			return err
+		})
+		for _, off := range dropped {
+			DB.recovery.Corrupted = append(DB.recovery.Corrupted, WalCorruption{File: path, Offset: off})
 		}
-		ext := filepath.Ext(path)
-		curr, err = page.InitPage(path, Flag, os.FileMode(Permission), uint16(PageSize), Fsync, SyncInterval)
+		DB.recovery.Dropped += len(dropped)
 		if err != nil {
+			wal.Close()
+			for _, segs := range wals {
+				for _, seg := range segs {
+					seg.Close()
+				}
+			}
+			return 0, err
+		}
+
+		// a segment can be removed only once the newest
+		// memtable holding its records is flushed
+		wals[0] = append(wals[0], wal)
+	}
+
+	DB.memtables = append(mems, DB.memtables...)
+	DB.wal = append(wals, DB.wal...)
+	return oldest, nil
+}
+
+func (DB *IrisDB) newWal(name string) (*WAL, error) {
+	return NewWal(name, DB.opts.Permission, uint16(DB.opts.PageSize), !DB.opts.DisableSync, DB.opts.SyncInterval)
+}
+
+// create new active memtable with its own WAL
+// caller must hold DB.mu
+func (DB *IrisDB) newMemtable() error {
+	wal, err := DB.newWal(walName(DB.path, DB.newFileNum()))
+	if err != nil {
+		return err
+	}
+	DB.memtables = append([]*skiplist.SkipList{skiplist.NewSkipList(uint32(DB.opts.MemTableSize))}, DB.memtables...)
+	DB.wal = append([][]*WAL{{wal}}, DB.wal...)
+	return nil
+}
+
+// freeze the active memtable (if it is still mem)
+// and let the flusher turn it into level-0 table
+// start a new log segment for the active memtable
+// once the current one is full
+func (DB *IrisDB) roll(wal *WAL) error {
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	// another writer already rolled it (or rotated the memtable)
+	segs := DB.wal[0]
+	if segs[len(segs)-1] != wal {
+		return nil
+	}
+	if err := wal.Sync(); err != nil {
+		return err
+	}
+	seg, err := DB.newWal(walName(DB.path, DB.newFileNum()))
+	if err != nil {
+		return err
+	}
+	DB.wal[0] = append(segs, seg)
+	return nil
+}
+
+func (DB *IrisDB) rotate(mem *skiplist.SkipList) error {
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	// another writer already rotated it
+	if DB.memtables[0] != mem {
+		return nil
+	}
+
+	// stall while flushing falls behind
+	// so immutable memtables can't pile up without bound
+	for len(DB.memtables)-1 >= DB.opts.MaxImmutableMemtables {
+		if DB.isClosed.Load() {
+			return ErrDBClosed
+		}
+		if err := DB.backgroundError(); err != nil {
 			return err
 		}
-		if ext == WalExtension {
-			wal := &WAL{page: curr}
-			mem := skiplist.NewSkipList(uint32(MemTableSize))
-			wal.Replay(func(log *LogEntry) error {
+		DB.flushed.Wait()
+		if DB.memtables[0] != mem {
+			return nil
+		}
+	}
+	segs := DB.wal[0]
+	if err := segs[len(segs)-1].Sync(); err != nil {
+		return err
+	}
+	if err := DB.newMemtable(); err != nil {
+		return err
+	}
+	DB.scheduleFlush()
+	return nil
+}
+
+func (DB *IrisDB) scheduleFlush() {
+	select {
+	case DB.flushC <- struct{}{}:
+	default:
+		// flush already pending
+	}
+}
+
+// WriteOptions control the durability of a single write
+// (nil options are the zero value)
+type WriteOptions struct {
+	// return only after the WAL record is fsynced
+	Sync bool
+
+	// skip the WAL. the write is lost on crash
+	// until its memtable is flushed
+	DisableWAL bool
+}
 
-				// TODO : Handle error
-				mem.Insert(log.Key, db.NewValue(log.Value))
-				return nil
-			})
+// ReadOptions control a single read
+// (nil options are DefaultReadOptions)
+type ReadOptions struct {
+	// don't check page checksums of the table data read
+	// (checked reads fail on a mismatch with *page.ErrCorruption)
+	SkipChecksums bool
+}
+
+func DefaultReadOptions() *ReadOptions {
+	return &ReadOptions{}
+}
+
+// Put insert key-value pair into the DB
+func (DB *IrisDB) Put(key, value []byte, opts *WriteOptions) error {
+	b := NewWriteBatch()
+	b.Put(key, value)
+	return DB.Write(b, opts)
+}
+
+// Delete remove key from the DB by writing a tombstone
+func (DB *IrisDB) Delete(key []byte, opts *WriteOptions) error {
+	b := NewWriteBatch()
+	b.Delete(key)
+	return DB.Write(b, opts)
+}
+
+// Write applies all updates of the batch atomically
+// the batch is logged as a single WAL record
+func (DB *IrisDB) Write(b *WriteBatch, opts *WriteOptions) error {
+	// txns start and check conflicts only
+	// while no write is between its ts and its memtable
+	DB.commitMu.RLock()
+	defer DB.commitMu.RUnlock()
+	return DB.write(b, opts)
+}
+
+// caller must hold commitMu
+func (DB *IrisDB) write(b *WriteBatch, opts *WriteOptions) error {
+	if opts == nil {
+		opts = &WriteOptions{}
+	}
+	if b.err != nil {
+		return b.err
+	}
+	if DB.isClosed.Load() {
+		return ErrDBClosed
+	}
+	if err := DB.backgroundError(); err != nil {
+		return err
+	}
+	if b.Count() == 0 {
+		return nil
+	}
+
+	// even an empty memtable can't hold more than room
+	need := b.memSize()
+	room := skiplist.Room(uint32(DB.opts.MemTableSize))
+	if need > room {
+		return ErrBatchTooLarge
+	}
+
+	for {
+		if DB.isClosed.Load() {
+			return ErrDBClosed
 		}
-		if ext == SSTABLEExtesnion {
-			lv := extractLevel(path)
-			if lv == -1 {
-				return err
-			}
-			key, err = page.InitPage(path+KeyExtension, Flag, os.FileMode(Permission), uint16(PageSize), Fsync, SyncInterval)
-			if err != nil {
-				return err
+		if err := DB.backgroundError(); err != nil {
+			return err
+		}
+		DB.mu.RLock()
+		mem, segs := DB.memtables[0], DB.wal[0]
+		wal := segs[len(segs)-1]
+
+		// room is reserved before logging. so a logged
+		// batch always fits and is never logged twice
+		if !mem.Reserve(need) {
+			DB.mu.RUnlock()
+			// rotating an empty memtable never helps
+			if mem.Free() == room {
+				return ErrBatchTooLarge
 			}
-			val, err = page.InitPage(path+ValExtension, Flag, os.FileMode(Permission), uint16(PageSize), Fsync, SyncInterval)
-			if err != nil {
+			if err := DB.rotate(mem); err != nil {
 				return err
 			}
+			continue
+		}
 
-			lastPg := key.GetLastPage()
-			mgNum, _, err := key.Read(uint16(lastPg))
+		// log first. so anything in the memtable can be recovered
+		// the log gives the ts so it is ordered like the log
+		var ts uint64
+		if !DB.opts.DisableWAL && !opts.DisableWAL {
+			var err error
+			ts, err = wal.LogBatch(b, opts.Sync)
 			if err != nil {
+				DB.mu.RUnlock()
 				return err
 			}
-			magicNum := binary.BigEndian.Uint64(mgNum[:8])
-			if magicNum != uint64(MagicNumber) {
-				return errors.New("sstable data is corrupted")
-			}
+		} else {
+			ts = db.Now()
+		}
+		err := b.apply(mem, ts)
+		DB.mu.RUnlock()
 
-			// Load index and bf into memory
-			indexAsBytes, _, err := key.Read(uint16(lastPg - 1))
-			if err != nil {
-				return err
+		if err == nil && wal.Size() >= uint64(DB.opts.WalSegmentSize) {
+			err = DB.roll(wal)
+		}
+		return err
+	}
+}
+
+// flush immutable memtables (oldest first) in background
+func (DB *IrisDB) flushProcess() {
+	defer DB.wg.Done()
+	for {
+		select {
+		case <-DB.flushC:
+		case <-DB.close:
+			return
+		}
+		for {
+			DB.mu.RLock()
+			n := len(DB.memtables)
+			if n <= 1 {
+				DB.mu.RUnlock()
+				break
 			}
-			bfAsBytes, _, err := key.Read(uint16(lastPg - 2))
+			mem, segs := DB.memtables[n-1], DB.wal[n-1]
+			DB.mu.RUnlock()
 
-			if err != nil {
-				return err
+			if err := DB.flush(mem, segs); err != nil {
+				DB.setBackgroundError(err)
+				break
 			}
-			bf := filter.Desrialize(*bytes.NewBuffer(bfAsBytes))
-			index := DeserializeIndex(*bytes.NewBuffer(indexAsBytes))
+		}
+	}
+}
+
+// keep the first background failure
+// writes fail from now on so unflushed memtables can't pile up
+func (DB *IrisDB) setBackgroundError(err error) {
+	DB.bgMu.Lock()
+	if DB.bgErr == nil {
+		DB.bgErr = err
+	}
+	DB.bgMu.Unlock()
+
+	// stalled writers must not wait for a flush that won't come
+	DB.mu.Lock()
+	DB.flushed.Broadcast()
+	DB.mu.Unlock()
+}
+
+func (DB *IrisDB) backgroundError() error {
+	DB.bgMu.Lock()
+	defer DB.bgMu.Unlock()
+	return DB.bgErr
+}
+
+// write frozen memtable into new level-0 table
+// then retire the memtable and its log
+func (DB *IrisDB) flush(mem *skiplist.SkipList, segs []*WAL) error {
+	sst, err := NewSSTABLE(DB.path, DB.newFileNum(), 0, DB.opts)
+	if err != nil {
+		return err
+	}
 
-			sst := &SSTABLE{keys: key, vals: val, filter: bf, index: index, size: uint64(SstableSize) * uint64(SizeMultiple*(int(lv)+1))}
-			sstables[lv] = append(sstables[lv], sst)
+	// every version. the clock may run ahead of wall time
+	it := skiplist.NewiteratorAt(mem, math.MaxUint64)
+	for it.SeekToStart(); it.Valid(); it.Next() {
+		if err = sst.add(it.GetKey(), it.Get()); err != nil {
+			break
 		}
-		DB.sstables = sstables
-		return nil
-	})
+	}
+	it.Close()
+	if err == nil {
+		err = sst.finish()
+	}
 	if err != nil {
-		return nil, err
+		sst.remove()
+		return err
 	}
-	go DB.compact()
-	return DB, err
+
+	DB.mu.Lock()
+	if sst.count > 0 {
+		err := DB.manifest.logEdit(&versionEdit{
+			added:    []tableMeta{metaOf(0, sst)},
+			nextFile: DB.nextFile.Load(),
+			logNum:   newestLog(segs),
+		})
+		if err != nil {
+			DB.mu.Unlock()
+			sst.remove()
+			return err
+		}
+		levels := DB.cloneLevels()
+		levels[0] = append([]*SSTABLE{sst}, levels[0]...)
+		DB.sstables = levels
+	}
+	n := len(DB.memtables)
+	DB.memtables = DB.memtables[:n-1]
+	DB.wal = DB.wal[:n-1]
+	DB.flushed.Broadcast()
+	DB.mu.Unlock()
+
+	if sst.count == 0 {
+		sst.remove()
+	} else {
+		DB.scheduleCompaction()
+	}
+
+	// data is durable in the table now
+	DB.purgeUpdates(segs)
+	var errs []error
+	for _, wal := range segs {
+		errs = append(errs, wal.Remove())
+	}
+	return errors.Join(errs...)
 }
 
-func (DB *IrisDB) compact() {
+// number of the newest log segment (0 if none)
+// logs of a memtable are newer than those of older memtables
+// so every log up to it is flushed with the memtable
+func newestLog(segs []*WAL) uint64 {
+	if len(segs) == 0 {
+		return 0
+	}
+	num, _ := parseFileNum(segs[len(segs)-1].name)
+	return num
+}
 
+// take current memtables and tables
+// tables are referenced until unrefTables is called
+func (DB *IrisDB) acquire() ([]*skiplist.SkipList, [][]*SSTABLE) {
+	DB.mu.RLock()
+	defer DB.mu.RUnlock()
+	for _, lv := range DB.sstables {
+		for _, sst := range lv {
+			sst.ref()
+		}
+	}
+	return DB.memtables, DB.sstables
+}
+
+func unrefTables(levels [][]*SSTABLE) {
+	for _, lv := range levels {
+		for _, sst := range lv {
+			sst.unref()
+		}
+	}
+}
+
+// copy of the levels layout so readers holding
+// the old one are never affected by a change
+// caller must hold DB.mu
+func (DB *IrisDB) cloneLevels() [][]*SSTABLE {
+	levels := make([][]*SSTABLE, len(DB.sstables))
+	for i, lv := range DB.sstables {
+		levels[i] = append([]*SSTABLE(nil), lv...)
+	}
+	return levels
+}
+
+// Close stop background work and close all files
+// unflushed memtables are recovered from their logs on next open
+func (DB *IrisDB) Close() error {
+	if !DB.isClosed.CompareAndSwap(false, true) {
+		return nil
+	}
+	close(DB.close)
+	DB.mu.Lock()
+	DB.flushed.Broadcast()
+	DB.mu.Unlock()
+	DB.wg.Wait()
+
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+	return errors.Join(DB.closeFiles(), DB.lock.Close(), DB.backgroundError())
+}
+
+// close logs, manifest and tables of DB
+// caller must hold DB.mu (or own DB during open)
+func (DB *IrisDB) closeFiles() error {
+	var errs []error
+	for _, segs := range DB.wal {
+		for _, wal := range segs {
+			errs = append(errs, wal.Close())
+		}
+	}
+	if DB.manifest != nil {
+		errs = append(errs, DB.manifest.Close())
+	}
+
+	// tables still used by readers are closed by the last one
+	for _, lv := range DB.sstables {
+		for _, sst := range lv {
+			errs = append(errs, sst.unref())
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func NewSSTABLE(level int) (*SSTABLE, error) {
+func NewSSTABLE(dir string, fileNum uint64, level int, opts *Options) (*SSTABLE, error) {
 
 	/*
 		SSTABLE STRUCTURE
 		-----------------------------------------------
 
 		KEYS
-		------------------------------------------------------------------------------
-		| Block | Block | .... | Bloom filter | Index (e.g: firstLetter --> (offset) |
-		------------------------------------------------------------------------------
+		---------------------------------------------------------------------------------------
+		| Block | Block | .... | Bloom filter | Index (e.g: firstLetter --> (offset) | Footer |
+		---------------------------------------------------------------------------------------
 
 		VALS
 		------------------
 		| Val | Val |....|
 		------------------
 
+		FOOTER
+		----------------------------------------------------------
+		| FilterPgNum(4) | IndexPgNum(4) | Version(4) | Magic(8) |
+		----------------------------------------------------------
+
 		NOTE : KEYS OR VALS CAN BE COMPRESSED
 	*/
-	name := fmt.Sprintf("%s-%02d-%d", DBName, level, time.Now().Second())
-	keys, err := page.InitPage(name+KeyExtension, Flag, os.FileMode(Permission), uint16(PageSize), Fsync, SyncInterval)
+	name := tableName(dir, fileNum)
+	keys, vals, err := openTableFiles(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	size := tableSize(level, opts)
+	bf, err := filter.NewBloomFilter(uint32(size/uint64(opts.AvgKeySize)), opts.FalsePositiveProb)
 	if err != nil {
+		keys.Close()
+		vals.Close()
 		return nil, err
 	}
-	vals, err := page.InitPage(name+ValExtension, Flag, os.FileMode(Permission), uint16(PageSize), Fsync, SyncInterval)
+	sst := &SSTABLE{
+		name:    name,
+		fileNum: fileNum,
+		keys:    keys,
+		vals:    vals,
+		filter:  bf,
+		index:   &IndexBlock{},
+		size:    size,
+		opts:    opts,
+	}
+	sst.refs.Store(1)
+	return sst, nil
+}
+
+func openTableFiles(name string, opts *Options) (*page.Page, *page.Page, error) {
+	keys, err := page.InitPage(name+KeyExtension, Flag, opts.Permission, uint16(opts.PageSize), !opts.DisableSync, opts.SyncInterval)
+	if err != nil {
+		return nil, nil, err
+	}
+	vals, err := page.InitPage(name+ValExtension, Flag, opts.Permission, uint16(opts.PageSize), !opts.DisableSync, opts.SyncInterval)
 	if err != nil {
+		keys.Close()
+		return nil, nil, err
+	}
+	if opts.PageCache != nil {
+		keys.SetCache(opts.PageCache)
+		vals.SetCache(opts.PageCache)
+	}
+	return keys, vals, nil
+}
+
+// open committed table and load its filter & index into memory
+func openSSTABLE(dir string, meta tableMeta, opts *Options) (*SSTABLE, error) {
+	name := tableName(dir, meta.fileNum)
+	keys, vals, err := openTableFiles(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	sst := &SSTABLE{
+		name:     name,
+		fileNum:  meta.fileNum,
+		keys:     keys,
+		vals:     vals,
+		size:     tableSize(meta.level, opts),
+		smallest: meta.smallest,
+		largest:  meta.largest,
+		opts:     opts,
+	}
+	if err := sst.mmap(); err != nil {
+		sst.close()
+		return nil, err
+	}
+	if err := sst.load(); err != nil {
+		sst.close()
 		return nil, err
 	}
-	return &SSTABLE{keys: keys, vals: vals, size: uint64(SstableSize) * uint64(SizeMultiple*(level+1))}, nil
+	sst.refs.Store(1)
+	return sst, nil
+}
+
+func (sst *SSTABLE) load() error {
+	lastPg := sst.keys.GetLastPage()
+	if lastPg == 0 {
+		return ErrCorruptSST
+	}
+	footer, _, err := sst.keys.Read(lastPg - 1)
+	if err != nil {
+		return err
+	}
+	n := len(footer)
+	if n < 16 || binary.BigEndian.Uint64(footer[n-8:]) != uint64(MagicNumber) {
+		return ErrCorruptSST
+	}
+
+	// v1 footer had no version and 2 bytes value pointers
+	if n != 20 || binary.BigEndian.Uint32(footer[8:12]) != FormatVersion {
+		return ErrFormatVersion
+	}
+
+	// Load index and bf into memory
+	bfAsBytes, _, err := sst.keys.Read(binary.BigEndian.Uint32(footer[0:4]))
+	if err != nil {
+		return err
+	}
+	indexAsBytes, _, err := sst.keys.Read(binary.BigEndian.Uint32(footer[4:8]))
+	if err != nil {
+		return err
+	}
+	sst.filter, err = filter.Deserialize(bfAsBytes)
+	if err != nil {
+		return err
+	}
+	sst.index, err = DeserializeIndex(indexAsBytes)
+	return err
+}
+
+// add key (with ts) and its value to the table
+// keys must be added in sorted order
+func (sst *SSTABLE) add(key, val []byte) error {
+	raw := db.RawKey(key)
+	if sst.block != nil && sst.block.keys[0][ValPtrSize] != raw[0] {
+		if err := sst.writeBlock(); err != nil {
+			return err
+		}
+	}
+	valPg, err := sst.vals.Write(val)
+	if err != nil {
+		return err
+	}
+	entry := make([]byte, ValPtrSize+len(key))
+	binary.BigEndian.PutUint32(entry[:ValPtrSize], valPg)
+	copy(entry[ValPtrSize:], key)
+
+	if sst.block == nil {
+		sst.block = &Block{}
+	}
+	sst.block.keys = append(sst.block.keys, entry)
+	sst.filter.Add(raw)
+	if sst.count == 0 {
+		sst.smallest = entry[ValPtrSize:]
+	}
+	sst.largest = entry[ValPtrSize:]
+	sst.count++
+	return nil
+}
+
+// every block holds keys sharing the same first byte
+func (sst *SSTABLE) writeBlock() error {
+	data := sst.block.SerializeBlock()
+	if !sst.opts.DisableCompression {
+		data = compress(data)
+	}
+	pg, err := sst.keys.Write(data)
+	if err != nil {
+		return err
+	}
+	sst.index.entries = append(sst.index.entries, IndexEntry{
+		key: sst.block.keys[0][ValPtrSize],
+		off: pg,
+	})
+	sst.block = nil
+	return nil
+}
+
+// write the remaining block, filter, index and footer
+// and make sure everything reached the disk
+func (sst *SSTABLE) finish() error {
+	if sst.block != nil {
+		if err := sst.writeBlock(); err != nil {
+			return err
+		}
+	}
+	bfPg, err := sst.keys.Write(sst.filter.Serialize())
+	if err != nil {
+		return err
+	}
+	indexPg, err := sst.keys.Write(sst.index.SerializeIndex())
+	if err != nil {
+		return err
+	}
+	footer := make([]byte, 20)
+	binary.BigEndian.PutUint32(footer[0:4], bfPg)
+	binary.BigEndian.PutUint32(footer[4:8], indexPg)
+	binary.BigEndian.PutUint32(footer[8:12], FormatVersion)
+	binary.BigEndian.PutUint64(footer[12:20], uint64(MagicNumber))
+	if _, err = sst.keys.Write(footer); err != nil {
+		return err
+	}
+	if err = sst.vals.Sync(); err != nil {
+		return err
+	}
+	if err = sst.keys.Sync(); err != nil {
+		return err
+	}
+	return sst.mmap()
+}
+
+// map sealed table files if MmapTables is set
+// (plain reads are kept where mmap is unsupported)
+func (sst *SSTABLE) mmap() error {
+	if !sst.opts.MmapTables {
+		return nil
+	}
+	err := errors.Join(sst.keys.Mmap(page.AccessRandom), sst.vals.Mmap(page.AccessRandom))
+	if errors.Is(err, page.ErrMmapUnsupported) {
+		return nil
+	}
+	return err
 }
 
-func (sst *SSTABLE) find(key []byte) ([]byte, bool, error) {
+// returns value and ts of the newest version of key with ts <= ts
+func (sst *SSTABLE) find(key []byte, ts uint64, verify bool) ([]byte, uint64, bool, error) {
 	found := sst.filter.Contains(key)
 	if !found {
-		return nil, false, nil
+		return nil, 0, false, nil
 	}
 	pgNum, found := sst.index.find(key[0])
 	if !found {
-		return nil, false, nil
+		return nil, 0, false, nil
 	}
-	dx, _, err := sst.keys.Read(uint16(pgNum))
+	block, err := sst.readBlock(pgNum, verify)
 	if err != nil {
-		return nil, false, err
-	}
-	var block *Block
-	if Compression {
-		dx = decompress(dx)
+		return nil, 0, false, err
 	}
-	block = DeserializeBlock(*bytes.NewBuffer(dx))
-	valPgNum, found := block.find(key)
+	valPgNum, version, found := block.find(key, ts)
 	if !found {
-		return nil, false, nil
+		return nil, 0, false, nil
+	}
+	read := sst.vals.Read
+	if !verify {
+		read = sst.vals.ReadUnverified
 	}
-	val, _, err := sst.vals.Read(valPgNum)
+	val, _, err := read(valPgNum)
 	if err != nil {
-		return nil, false, err
+		return nil, 0, false, err
 	}
-	return val, true, nil
+	return val, version, true, nil
+}
+
+func (sst *SSTABLE) readBlock(pgNum uint32, verify bool) (*Block, error) {
+	read := sst.keys.Read
+	if !verify {
+		read = sst.keys.ReadUnverified
+	}
+	dx, _, err := read(pgNum)
+	if err != nil {
+		return nil, err
+	}
+	if !sst.opts.DisableCompression {
+		dx = decompress(dx)
+	}
+	return DeserializeBlock(dx)
+}
+
+// actual size of table files
+func (sst *SSTABLE) Size() uint64 {
+	return uint64(sst.keys.Size()) + uint64(sst.vals.Size())
 }
 
 func (sst *SSTABLE) fullSize() bool {
 	return sst.size <= uint64(sst.keys.Size())+uint64(sst.vals.Size())
 }
 
+func (sst *SSTABLE) close() error {
+	return errors.Join(sst.keys.Close(), sst.vals.Close())
+}
+
+func (sst *SSTABLE) ref() {
+	sst.refs.Add(1)
+}
+
+// drop one reference. last one closes the table
+// and deletes its files if it was compacted away
+func (sst *SSTABLE) unref() error {
+	if sst.refs.Add(-1) > 0 {
+		return nil
+	}
+	if sst.obsolete.Load() {
+		return sst.remove()
+	}
+	return sst.close()
+}
+
+// close and delete table files
+func (sst *SSTABLE) remove() error {
+	return errors.Join(
+		sst.close(),
+		os.Remove(sst.name+KeyExtension),
+		os.Remove(sst.name+ValExtension),
+	)
+}
+
+// iterate table keys in order block by block
+type sstIterator struct {
+	sst    *SSTABLE
+	block  *Block
+	next   int  // next index entry to load
+	pos    int  // position inside block
+	verify bool // check page checksums
+	err    error
+}
+
+func newSSTIterator(sst *SSTABLE) *sstIterator {
+	it := &sstIterator{sst: sst, verify: true}
+	it.loadBlock()
+	return it
+}
+
+func (it *sstIterator) loadBlock() {
+	it.block, it.pos = nil, 0
+	for it.next < len(it.sst.index.entries) {
+		b, err := it.sst.readBlock(it.sst.index.entries[it.next].off, it.verify)
+		it.next++
+		if err != nil {
+			it.err = err
+			return
+		}
+		if len(b.keys) > 0 {
+			it.block = b
+			return
+		}
+	}
+}
+
+// position at the first entry >= target (key with ts)
+func (it *sstIterator) seek(target []byte) {
+	first := db.RawKey(target)[0]
+	entries := it.sst.index.entries
+	it.next = sort.Search(len(entries), func(i int) bool {
+		return entries[i].key >= first
+	})
+	it.loadBlock()
+	if it.block == nil {
+		return
+	}
+	it.pos = sort.Search(len(it.block.keys), func(i int) bool {
+		return db.CompareKeys(it.block.keys[i][ValPtrSize:], target) >= 0
+	})
+	if it.pos == len(it.block.keys) {
+		it.loadBlock()
+	}
+}
+
+func (it *sstIterator) Valid() bool {
+	return it.block != nil
+}
+
+// current entry as | ValPgNum(4) | Key + Ts |
+func (it *sstIterator) Key() []byte {
+	return it.block.keys[it.pos]
+}
+
+func (it *sstIterator) Next() {
+	it.pos++
+	if it.pos >= len(it.block.keys) {
+		it.loadBlock()
+	}
+}
+
 // Merge N sstables
 type SSTMergeIterator struct {
-	heap  *MinHeap
-	vals  map[int]*page.Page
-	level int
+	heap           *MinHeap
+	vals           map[int]*page.Page
+	level          int
+	dropTombstones bool     // no older data below output level
+	snapshots      []uint64 // ts of live snapshots (oldest first)
+	lastKey        []byte   // raw key of last returned entry
+	lastStripe     int      // snapshot stripe of last returned entry
+	lastTs         uint64   // ts of last returned entry
+	horizon        uint64   // newest ts of a version that replaced a dropped one
+	retain         uint64   // versions visible at any ts after it are kept
 }
 
 type HeapItem struct {
-	it  *page.Iterator
+	it  *sstIterator
 	key []byte
-	id  int // sstable ID
+	id  int // sstable ID (lower is newer)
 
 }
 
@@ -207,7 +1129,7 @@ type MinHeap []*HeapItem
 func (h MinHeap) Len() int { return len(h) }
 
 func (h MinHeap) Less(i, j int) bool {
-	cmp := bytes.Compare(h[i].key, h[j].key)
+	cmp := db.CompareKeys(h[i].key[ValPtrSize:], h[j].key[ValPtrSize:])
 	if cmp < 0 {
 		return true
 	}
@@ -233,160 +1155,236 @@ func (h *MinHeap) Pop() any {
 	return item
 }
 
-func NewSSTMergeIterator(sstables []*SSTABLE, level int) *SSTMergeIterator {
+// sstables must be ordered from newest to oldest
+func NewSSTMergeIterator(sstables []*SSTABLE, level int) (*SSTMergeIterator, error) {
 
 	h := &MinHeap{}
 	heap.Init(h)
 	vals := make(map[int]*page.Page)
 
 	for id, sst := range sstables {
-		it := page.Newiterator(sst.keys)
+		it := newSSTIterator(sst)
+		if it.err != nil {
+			return nil, it.err
+		}
 		if !it.Valid() {
 			continue
 		}
-		key, _ := it.Get(uint16(it.Next()))
+		// inputs are read once in order
+		_ = sst.keys.Advise(page.AccessSequential)
+		_ = sst.vals.Advise(page.AccessSequential)
+
 		heapItem := &HeapItem{
-			key: key,
+			key: it.Key(),
 			id:  id,
 			it:  it,
 		}
 		heap.Push(h, heapItem)
 		vals[id] = sst.vals
 	}
-	return &SSTMergeIterator{heap: h, vals: vals, level: level}
+	return &SSTMergeIterator{heap: h, vals: vals, level: level}, nil
 }
 
+// return next version to keep and id of its table (nil key at the end)
+// a version is skipped if a newer one of the same key
+// is visible to the same snapshots and replaced it before retain
 func (smi *SSTMergeIterator) Next() ([]byte, int, error) {
-	if smi.heap.Len() <= 0 {
-		return nil, 0, errors.New("emtpy heap")
-	}
-	v := heap.Pop(smi.heap).(*HeapItem)
 	for smi.heap.Len() > 0 {
-		nxPop := heap.Pop(smi.heap).(*HeapItem)
-		if bytes.Equal(nxPop.key, v.key) {
-			if nxPop.it.Valid() {
-				nx := nxPop.it.Next()
-				nxItem, _ := nxPop.it.Get(uint16(nx))
-				smi.heap.Push(&HeapItem{
-					key: nxItem, id: nxPop.id, it: nxPop.it,
-				})
+		v := heap.Pop(smi.heap).(*HeapItem)
+		if err := smi.advance(v); err != nil {
+			return nil, 0, err
+		}
+		key := v.key[ValPtrSize:]
+		s := stripe(smi.snapshots, db.GetTsAsUint64(key))
+		if smi.lastKey != nil && bytes.Equal(db.RawKey(key), smi.lastKey) {
+			if s == smi.lastStripe && smi.lastTs <= smi.retain {
+				smi.horizon = max(smi.horizon, smi.lastTs)
+				continue
 			}
-			continue
+		} else {
+			smi.lastKey = append(smi.lastKey[:0], db.RawKey(key)...)
 		}
-		heap.Push(smi.heap, nxPop)
-		break
+		smi.lastStripe = s
+		smi.lastTs = db.GetTsAsUint64(key)
+		return v.key, v.id, nil
+	}
+	return nil, 0, nil
+}
+
+// push next key of item table (if any)
+func (smi *SSTMergeIterator) advance(item *HeapItem) error {
+	item.it.Next()
+	if item.it.err != nil {
+		return item.it.err
 	}
-	if v.it.Valid() {
-		nx := v.it.Next()
-		nxItem, _ := v.it.Get(uint16(nx))
-		smi.heap.Push(&HeapItem{
-			key: nxItem, id: v.id, it: v.it,
+	if item.it.Valid() {
+		heap.Push(smi.heap, &HeapItem{
+			key: item.it.Key(), id: item.id, it: item.it,
 		})
 	}
-	return v.key, v.id, nil
+	return nil
 }
 
-func (smi *SSTMergeIterator) CreateSST() ([]*SSTABLE, error) {
+// newFileNum allocates names of the output tables
+func (smi *SSTMergeIterator) CreateSST(dir string, newFileNum func() uint64, opts *Options) (sstables []*SSTABLE, err error) {
 
-	var sstables []*SSTABLE
-	sst, err := NewSSTABLE(smi.level)
+	sst, err := NewSSTABLE(dir, newFileNum(), smi.level, opts)
 	if err != nil {
 		return nil, err
 	}
-	mp := make(map[byte]bool)
-	for smi.heap.Len() > 0 {
-		key, id, err := smi.Next()
-		if err != nil {
-			return nil, err
-		}
-		pgNum := binary.BigEndian.Uint16(key[:2])
-		val, _, err := smi.vals[id].Read(pgNum)
+
+	// never leave half written outputs behind
+	defer func() {
 		if err != nil {
-			return nil, err
+			if sst != nil {
+				sst.remove()
+			}
+			for _, t := range sstables {
+				t.remove()
+			}
+			sstables = nil
 		}
-		sst.filter.Add(key[2:])
-		newPg, err := sst.vals.Write(val)
+	}()
+
+	for {
+		key, id, err := smi.Next()
 		if err != nil {
-			return nil, err
+			return sstables, err
 		}
-		binary.BigEndian.PutUint16(key[:2], uint16(newPg))
-		keyPg, err := sst.keys.Write(key)
-		if !mp[key[2]] {
-			sst.index.entries = append(sst.index.entries, IndexEntry{
-				key: key[2],
-				off: keyPg,
-			})
-			mp[key[2]] = true
+		if key == nil {
+			break
 		}
-
+		pgNum := binary.BigEndian.Uint32(key[:ValPtrSize])
+		val, _, err := smi.vals[id].Read(pgNum)
 		if err != nil {
-			return nil, err
+			return sstables, err
 		}
-		if sst.fullSize() {
 
-			// IndexBlock maxSize := 256 * 8
-			// intiallize buf of size fitler once
-			// it will handle both
-			buf := make([]byte, sst.size)
+		// older versions of a tombstone in the first stripe are dropped as well
+		// so no snapshot can see anything below it
+		if smi.dropTombstones && smi.lastStripe == 0 && smi.lastTs <= smi.retain && bytes.Equal(val, TOMPOSTONE) {
+			smi.horizon = max(smi.horizon, smi.lastTs)
+			continue
+		}
 
-			sst.index.SerializeIndex(*bytes.NewBuffer(buf))
-			_, err = sst.keys.Write(buf)
-			if err != nil {
-				return nil, err
-			}
-			sst.filter.Serialize(*bytes.NewBuffer(buf))
-			_, err = sst.keys.Write(buf)
-			if err != nil {
-				return nil, err
+		// split only between different keys
+		// so tables in the same level never overlap
+		if sst.fullSize() && db.CompareRawKeys(sst.largest, key[ValPtrSize:]) != 0 {
+			if err = sst.finish(); err != nil {
+				return sstables, err
 			}
-			binary.BigEndian.PutUint32(buf[:8], MagicNumber)
-			_, err = sst.keys.Write(buf[:8])
+			sstables = append(sstables, sst)
+			sst, err = NewSSTABLE(dir, newFileNum(), smi.level, opts)
 			if err != nil {
-				return nil, err
+				return sstables, err
 			}
-			sstables = append(sstables, sst)
-			sst, _ = NewSSTABLE(smi.level)
+		}
+		if err = sst.add(key[ValPtrSize:], val); err != nil {
+			return sstables, err
 		}
 	}
-	return sstables, nil
-}
-
-func extractLevel(path string) int64 {
-	splits := strings.Split(path, "-")
-	if len(splits) != 3 {
-		return -1 // err
+	if sst.count == 0 {
+		sst.remove()
+		sst = nil
+		return sstables, nil
 	}
-	if v, err := strconv.ParseInt(splits[1], 10, 64); err == nil {
-		return v
+	if err = sst.finish(); err != nil {
+		return sstables, err
 	}
-	return -1
+	return append(sstables, sst), nil
 }
 
 // TODO:
 // avoid suddenly flush when read
-func (db *IrisDB) Read(key []byte) ([]byte, error) {
-	for _, mem := range db.memtables {
+func (DB *IrisDB) Read(key []byte, opts *ReadOptions) ([]byte, error) {
+	if opts == nil {
+		opts = DefaultReadOptions()
+	}
+	return DB.get(key, math.MaxUint64, !opts.SkipChecksums)
+}
+
+// PageCacheStats returns counters of the table page cache
+// (zero if it is disabled)
+func (DB *IrisDB) PageCacheStats() page.CacheStats {
+	if DB.opts.PageCache == nil {
+		return page.CacheStats{}
+	}
+	return DB.opts.PageCache.Stats()
+}
 
-		val, found := mem.Get(key)
+// ReadAt return the value key had at ts
+// (the newest version written at or before ts)
+//
+// NOTE: compaction keeps the versions needed to read at any ts within
+// Options.HistoryRetention (and those needed by live snapshots). older ones
+// may be dropped and ts before the newest version that replaced a dropped
+// one fail with ErrTsCompacted for every key. use GetSnapshot to keep
+// a point in time readable beyond the retention
+func (DB *IrisDB) ReadAt(key []byte, ts time.Time, opts *ReadOptions) ([]byte, error) {
+	if opts == nil {
+		opts = DefaultReadOptions()
+	}
+	if ts.UnixNano() < 0 {
+		return nil, nil
+	}
+	if uint64(ts.UnixNano()) < DB.horizon.Load() {
+		return nil, ErrTsCompacted
+	}
+	return DB.get(key, uint64(ts.UnixNano()), !opts.SkipChecksums)
+}
+
+// newest version of key with ts <= ts
+// sources are searched from newest to oldest
+func (DB *IrisDB) get(key []byte, ts uint64, verify bool) ([]byte, error) {
+	val, _, err := DB.getVersion(key, ts, verify)
+	return val, err
+}
+
+// getVersion returns the newest value of key with ts <= ts
+// and ts of that version (0 if key has none)
+// a deleted key has nil value but still a version
+func (DB *IrisDB) getVersion(key []byte, ts uint64, verify bool) ([]byte, uint64, error) {
+	if len(key) == 0 {
+		return nil, 0, ErrEmptyKey
+	}
+	memtables, sstables := DB.acquire()
+	defer unrefTables(sstables)
+
+	k := db.NewKeyAt(key, ts)
+	for _, mem := range memtables {
+
+		val, version, found := mem.FindVersion(k, ts)
 
 		if !found {
 			continue
 		}
 		v := val.GetValue()
 		if !bytes.Equal(v, TOMPOSTONE) {
-			return v, nil
+			return v, version, nil
 		}
-		return nil, nil
+		return nil, version, nil
 	}
-	for _, sstLevel := range db.sstables {
+	for _, sstLevel := range sstables {
 		for _, sst := range sstLevel {
-			data, found, _ := sst.find(key)
-			if found {
-				return data, nil
+			data, version, found, err := sst.find(key, ts, verify)
+			if err != nil {
+				return nil, 0, err
+			}
+			if !found {
+				continue
+			}
+			if bytes.Equal(data, TOMPOSTONE) {
+				return nil, version, nil
+			}
+
+			// mapped data is gone once the table is released
+			if DB.opts.MmapTables {
+				data = bytes.Clone(data)
 			}
+			return data, version, nil
 		}
 	}
-	return nil, nil
+	return nil, 0, nil
 }
 
 func compress(data []byte) []byte {
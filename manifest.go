@@ -0,0 +1,290 @@
+package irisdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/alimx07/IrisDB/db"
+	"github.com/alimx07/IrisDB/page"
+)
+
+const (
+	CurrentFile    = "CURRENT"
+	ManifestPrefix = "MANIFEST-"
+)
+
+var (
+	ErrCorruptManifest = errors.New("manifest is corrupted")
+	crcTable           = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// table as recorded in the manifest
+type tableMeta struct {
+	level    int
+	fileNum  uint64
+	smallest []byte // ignored for deleted tables
+	largest  []byte
+}
+
+// one atomic change of the tables layout
+type versionEdit struct {
+	nextFile uint64 // last allocated file number
+	lastTs   uint64 // clock when the edit was logged
+	logNum   uint64 // logs numbered up to logNum are flushed (0 if unchanged)
+	horizon  uint64 // reads before it may miss versions dropped by compaction
+	added    []tableMeta
+	deleted  []tableMeta
+}
+
+func metaOf(level int, sst *SSTABLE) tableMeta {
+	return tableMeta{level: level, fileNum: sst.fileNum, smallest: sst.smallest, largest: sst.largest}
+}
+
+func (e *versionEdit) serialize() []byte {
+
+	/*
+		EDIT LAYOUT
+		------------------------------------------------------------------------------------------------------------
+		| CRC(4) | NextFile(8) | Added(4) | Added Tables | Deleted(4) | Del Tables | LastTs(8) | LogNum(8) | Horizon(8) |
+		------------------------------------------------------------------------------------------------------------
+		(LastTs, LogNum and Horizon are missing in edits of older versions)
+
+		ADDED TABLE
+		---------------------------------------------------------------------------
+		| Level(1) | FileNum(8) | SmallestLen(2) | Smallest | LargestLen(2) | Largest |
+		---------------------------------------------------------------------------
+
+		DELETED TABLE
+		-------------------------
+		| Level(1) | FileNum(8) |
+		-------------------------
+	*/
+
+	data := make([]byte, 4, 64)
+	data = binary.BigEndian.AppendUint64(data, e.nextFile)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(e.added)))
+	for _, t := range e.added {
+		data = append(data, byte(t.level))
+		data = binary.BigEndian.AppendUint64(data, t.fileNum)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(t.smallest)))
+		data = append(data, t.smallest...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(t.largest)))
+		data = append(data, t.largest...)
+	}
+	data = binary.BigEndian.AppendUint32(data, uint32(len(e.deleted)))
+	for _, t := range e.deleted {
+		data = append(data, byte(t.level))
+		data = binary.BigEndian.AppendUint64(data, t.fileNum)
+	}
+	data = binary.BigEndian.AppendUint64(data, e.lastTs)
+	data = binary.BigEndian.AppendUint64(data, e.logNum)
+	data = binary.BigEndian.AppendUint64(data, e.horizon)
+	binary.BigEndian.PutUint32(data[:4], crc32.Checksum(data[4:], crcTable))
+	return data
+}
+
+func deserializeEdit(data []byte) (*versionEdit, error) {
+	if len(data) < 20 || binary.BigEndian.Uint32(data[:4]) != crc32.Checksum(data[4:], crcTable) {
+		return nil, ErrCorruptManifest
+	}
+	e := &versionEdit{nextFile: binary.BigEndian.Uint64(data[4:12])}
+	d := data[12:]
+
+	// lengths are trusted as the checksum matched
+	n := binary.BigEndian.Uint32(d)
+	d = d[4:]
+	for range n {
+		t := tableMeta{level: int(d[0]), fileNum: binary.BigEndian.Uint64(d[1:9])}
+		sz := int(binary.BigEndian.Uint16(d[9:11]))
+		t.smallest = d[11 : 11+sz]
+		d = d[11+sz:]
+		sz = int(binary.BigEndian.Uint16(d[:2]))
+		t.largest = d[2 : 2+sz]
+		d = d[2+sz:]
+		e.added = append(e.added, t)
+	}
+	n = binary.BigEndian.Uint32(d)
+	d = d[4:]
+	for range n {
+		e.deleted = append(e.deleted, tableMeta{level: int(d[0]), fileNum: binary.BigEndian.Uint64(d[1:9])})
+		d = d[9:]
+	}
+	if len(d) >= 8 {
+		e.lastTs = binary.BigEndian.Uint64(d[:8])
+	}
+	if len(d) >= 16 {
+		e.logNum = binary.BigEndian.Uint64(d[8:16])
+	}
+	if len(d) >= 24 {
+		e.horizon = binary.BigEndian.Uint64(d[16:24])
+	}
+	return e, nil
+}
+
+// MANIFEST is a log of version edits
+// CURRENT points to the live one
+type Manifest struct {
+	name string
+	page *page.Page
+}
+
+// create new manifest holding a snapshot of levels and state
+// and make CURRENT point to it
+func createManifest(dir string, fileNum uint64, levels [][]tableMeta, state versionEdit, opts *Options) (*Manifest, error) {
+	name := manifestName(dir, fileNum)
+	pg, err := page.InitPage(name, Flag|os.O_TRUNC, opts.Permission, uint16(opts.PageSize), false, 0)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{name: name, page: pg}
+	snapshot := &versionEdit{nextFile: state.nextFile, logNum: state.logNum, horizon: state.horizon}
+	for _, lv := range levels {
+		snapshot.added = append(snapshot.added, lv...)
+	}
+	if err := m.logEdit(snapshot); err != nil {
+		m.page.Close()
+		os.Remove(name)
+		return nil, err
+	}
+	if err := setCurrent(dir, filepath.Base(name), opts.Permission); err != nil {
+		m.page.Close()
+		os.Remove(name)
+		return nil, err
+	}
+	return m, nil
+}
+
+// append edit and make it durable
+// every edit carries the clock so ts of flushed
+// data are not handed out again after a restart
+func (m *Manifest) logEdit(e *versionEdit) error {
+	e.lastTs = db.Last()
+	if _, err := m.page.Write(e.serialize()); err != nil {
+		return err
+	}
+	return m.page.Sync()
+}
+
+func (m *Manifest) Close() error {
+	return m.page.Close()
+}
+
+// switch CURRENT atomically with rename
+func setCurrent(dir, manifest string, perm os.FileMode) error {
+	return writeFileAtomic(dir, CurrentFile, []byte(manifest+"\n"), perm)
+}
+
+// replace dir/name with data through a synced tmp file and rename
+func writeFileAtomic(dir, name string, data []byte, perm os.FileMode) error {
+	tmp := filepath.Join(dir, name+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// make file creation/rename durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// replay manifest pointed by CURRENT into levels layout
+// state holds the newest nextFile, logNum and horizon of all edits
+// return empty name if db has no manifest yet
+func recoverManifest(dir string, opts *Options) (name string, levels [][]tableMeta, state versionEdit, err error) {
+	levels = make([][]tableMeta, opts.MaxLevels)
+	current, err := os.ReadFile(filepath.Join(dir, CurrentFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", levels, state, nil
+	}
+	if err != nil {
+		return "", nil, state, err
+	}
+	name = filepath.Join(dir, strings.TrimSpace(string(current)))
+	pg, err := page.InitPage(name, os.O_RDONLY, opts.Permission, uint16(opts.PageSize), false, 0)
+	if err != nil {
+		return "", nil, state, err
+	}
+	defer pg.Close()
+
+	it := page.Newiterator(pg)
+	for it.Valid() {
+		pgNum := it.Next()
+		data, err := it.Get(pgNum)
+		var e *versionEdit
+		if err == nil {
+			e, err = deserializeEdit(data)
+		}
+
+		// an edit torn by a crash while it was logged was never
+		// acknowledged. it is dropped with the rest of this manifest
+		// when the open rewrites the layout into a new one
+		torn := errors.Is(err, page.ErrCorruptPage) || err == io.EOF || err == ErrCorruptManifest
+		if torn && !editAfter(pg, pgNum+1) {
+			break
+		}
+		if err != nil {
+			return "", nil, state, err
+		}
+		state.nextFile = max(state.nextFile, e.nextFile)
+		state.logNum = max(state.logNum, e.logNum)
+		state.horizon = max(state.horizon, e.horizon)
+		db.Observe(e.lastTs)
+		for _, t := range e.deleted {
+			if t.level >= opts.MaxLevels {
+				return "", nil, state, ErrCorruptManifest
+			}
+			levels[t.level] = slices.DeleteFunc(levels[t.level], func(m tableMeta) bool {
+				return m.fileNum == t.fileNum
+			})
+		}
+		for _, t := range e.added {
+			if t.level >= opts.MaxLevels {
+				return "", nil, state, ErrCorruptManifest
+			}
+			levels[t.level] = append(levels[t.level], t)
+		}
+	}
+	return name, levels, state, nil
+}
+
+// reports whether a valid edit starts at a page from pgNum on
+// (a bad edit followed by good ones is real corruption)
+func editAfter(pg *page.Page, pgNum uint32) bool {
+	for ; pgNum < pg.GetLastPage(); pgNum++ {
+		data, _, err := pg.Read(pgNum)
+		if err != nil {
+			continue
+		}
+		if _, err := deserializeEdit(data); err == nil {
+			return true
+		}
+	}
+	return false
+}
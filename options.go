@@ -0,0 +1,239 @@
+package irisdb
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alimx07/IrisDB/page"
+	"github.com/alimx07/IrisDB/skiplist"
+)
+
+const (
+	OptionsFile = "OPTIONS"
+	LockFile    = "LOCK"
+)
+
+// Options of a single DB instance
+// zero fields take their default (so a zero Options is the default config)
+type Options struct {
+	CreateIfMissing bool // create the DB directory if it doesn't exist
+	ErrorIfExists   bool // fail if the DB was already created
+
+	PageSize          int // page size of every file. fixed once the DB is created
+	MemTableSize      int
+	SstableSize       int // size of a table and of level 0
+	SizeMultiple      int // SizeLevel(i) = Multiple * SizeLevel(i-1)
+	MaxLevels         int
+	AvgKeySize        int // used to size bloom filters
+	FalsePositiveProb float64
+	Permission        os.FileMode
+
+	DisableCompression bool // fixed once the DB is created
+	DisableSync        bool // no periodic fsync of written files
+	SyncInterval       time.Duration
+
+	PageCache        *page.Cache // cache of table pages. may be shared by DBs (nil creates one of PageCacheSize)
+	PageCacheSize    int
+	DisablePageCache bool
+	MmapTables       bool // read sealed tables through mmap (pages inside the mapping skip the cache)
+
+	DisableWAL     bool // writes are lost on crash until flushed
+	WalSegmentSize int  // log of a memtable rolls to a new file at this size
+	WalRecovery    RecoveryMode
+
+	MaxImmutableMemtables int // writes stall while this many memtables wait to be flushed
+
+	// compaction keeps every version readable by ReadAt
+	// within this long (zero keeps only what snapshots need)
+	HistoryRetention time.Duration
+
+	LockStripes int           // stripes of the txn lock table
+	LockTimeout time.Duration // max wait for a key lock
+}
+
+// OptionsError reports an invalid option or one that
+// doesn't match the options the DB was created with
+type OptionsError struct {
+	Field  string
+	Reason string
+}
+
+func (e *OptionsError) Error() string {
+	return "irisdb: option " + e.Field + " " + e.Reason
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		PageSize:          4096,
+		MemTableSize:      64 * 1024,
+		SstableSize:       128 * 1024,
+		SizeMultiple:      5,
+		MaxLevels:         6,
+		AvgKeySize:        16,
+		FalsePositiveProb: 0.01,
+		Permission:        0644,
+		PageCacheSize:     8 * 1024 * 1024,
+		SyncInterval:      100 * time.Millisecond,
+		WalSegmentSize:    4 * 1024 * 1024, // records take whole pages so logs outgrow memtables
+		WalRecovery:       TolerateCorruptedTail,
+		LockStripes:       64,
+		LockTimeout:       time.Second,
+
+		MaxImmutableMemtables: 4,
+	}
+}
+
+// copy of opts with defaults filled in
+func (opts *Options) withDefaults() *Options {
+	o := DefaultOptions()
+	if opts == nil {
+		return o
+	}
+	def := *o
+	*o = *opts
+	setDefault(&o.PageSize, def.PageSize)
+	setDefault(&o.MemTableSize, def.MemTableSize)
+	setDefault(&o.SstableSize, def.SstableSize)
+	setDefault(&o.SizeMultiple, def.SizeMultiple)
+	setDefault(&o.MaxLevels, def.MaxLevels)
+	setDefault(&o.AvgKeySize, def.AvgKeySize)
+	setDefault(&o.FalsePositiveProb, def.FalsePositiveProb)
+	setDefault(&o.Permission, def.Permission)
+	setDefault(&o.PageCacheSize, def.PageCacheSize)
+	setDefault(&o.SyncInterval, def.SyncInterval)
+	setDefault(&o.WalSegmentSize, def.WalSegmentSize)
+	setDefault(&o.MaxImmutableMemtables, def.MaxImmutableMemtables)
+	setDefault(&o.LockStripes, def.LockStripes)
+	setDefault(&o.LockTimeout, def.LockTimeout)
+	return o
+}
+
+func setDefault[T comparable](field *T, def T) {
+	var zero T
+	if *field == zero {
+		*field = def
+	}
+}
+
+func (opts *Options) validate() error {
+	switch {
+	case opts.PageSize < 256 || opts.PageSize > 32*1024 || opts.PageSize&(opts.PageSize-1) != 0:
+		return &OptionsError{"PageSize", "must be a power of two in [256, 32768]"}
+	case opts.MemTableSize < 16*int(skiplist.MaxSize):
+		return &OptionsError{"MemTableSize", "is too small"}
+	case opts.SstableSize < opts.PageSize:
+		return &OptionsError{"SstableSize", "must be at least PageSize"}
+	case opts.SizeMultiple < 2:
+		return &OptionsError{"SizeMultiple", "must be at least 2"}
+	case opts.MaxLevels < 2 || opts.MaxLevels > 0xFF:
+		return &OptionsError{"MaxLevels", "must be in [2, 255]"}
+	case opts.AvgKeySize < 0:
+		return &OptionsError{"AvgKeySize", "must be positive"}
+	case opts.FalsePositiveProb <= 0 || opts.FalsePositiveProb >= 1:
+		return &OptionsError{"FalsePositiveProb", "must be in (0, 1)"}
+	case opts.PageCacheSize < 0:
+		return &OptionsError{"PageCacheSize", "must be positive"}
+	case opts.SyncInterval < 0:
+		return &OptionsError{"SyncInterval", "must be positive"}
+	case opts.WalSegmentSize < opts.PageSize:
+		return &OptionsError{"WalSegmentSize", "must be at least PageSize"}
+	case opts.WalRecovery < TolerateCorruptedTail || opts.WalRecovery > SkipCorruptedRecords:
+		return &OptionsError{"WalRecovery", "is unknown"}
+	case opts.HistoryRetention < 0:
+		return &OptionsError{"HistoryRetention", "must be positive"}
+	case opts.MaxImmutableMemtables < 0:
+		return &OptionsError{"MaxImmutableMemtables", "must be positive"}
+	case opts.LockStripes < 0:
+		return &OptionsError{"LockStripes", "must be positive"}
+	case opts.LockTimeout < 0:
+		return &OptionsError{"LockTimeout", "must be positive"}
+	}
+	return nil
+}
+
+// options that change the on-disk format must match the stored ones
+func (opts *Options) checkCompatible(stored map[string]string) error {
+	// files of DBs created before FormatVersion was stored can't be read
+	if stored != nil && stored["FormatVersion"] != strconv.Itoa(FormatVersion) {
+		return ErrFormatVersion
+	}
+	if v, ok := stored["PageSize"]; ok && v != strconv.Itoa(opts.PageSize) {
+		return &OptionsError{"PageSize", "differs from the DB page size " + v}
+	}
+	if v, ok := stored["DisableCompression"]; ok && v != strconv.FormatBool(opts.DisableCompression) {
+		return &OptionsError{"DisableCompression", "differs from the DB setting " + v}
+	}
+	if v, ok := stored["MaxLevels"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return ErrCorruptOptions
+		}
+		if opts.MaxLevels < n {
+			return &OptionsError{"MaxLevels", "is less than the DB levels " + v}
+		}
+	}
+	return nil
+}
+
+var ErrCorruptOptions = errors.New("options file is corrupted")
+
+/*
+	OPTIONS FILE
+	-------------------
+	| Field=Value     |
+	| Field=Value ... |
+	-------------------
+	rewritten on every open with the options in use
+*/
+
+func (opts *Options) serialize() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "FormatVersion=%d\n", FormatVersion)
+	fmt.Fprintf(&buf, "PageSize=%d\n", opts.PageSize)
+	fmt.Fprintf(&buf, "MemTableSize=%d\n", opts.MemTableSize)
+	fmt.Fprintf(&buf, "SstableSize=%d\n", opts.SstableSize)
+	fmt.Fprintf(&buf, "SizeMultiple=%d\n", opts.SizeMultiple)
+	fmt.Fprintf(&buf, "MaxLevels=%d\n", opts.MaxLevels)
+	fmt.Fprintf(&buf, "AvgKeySize=%d\n", opts.AvgKeySize)
+	fmt.Fprintf(&buf, "FalsePositiveProb=%g\n", opts.FalsePositiveProb)
+	fmt.Fprintf(&buf, "DisableCompression=%t\n", opts.DisableCompression)
+	fmt.Fprintf(&buf, "DisableWAL=%t\n", opts.DisableWAL)
+	fmt.Fprintf(&buf, "WalSegmentSize=%d\n", opts.WalSegmentSize)
+	return buf.Bytes()
+}
+
+// stored options of the DB in dir (nil if it has none yet)
+func readOptions(dir string) (map[string]string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, OptionsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, ErrCorruptOptions
+		}
+		stored[k] = v
+	}
+	return stored, sc.Err()
+}
+
+func writeOptions(dir string, opts *Options) error {
+	return writeFileAtomic(dir, OptionsFile, opts.serialize(), opts.Permission)
+}
@@ -0,0 +1,135 @@
+package irisdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOptionsValidate(t *testing.T) {
+	if err := DefaultOptions().validate(); err != nil {
+		t.Fatalf("Expected default options to be valid, got %v", err)
+	}
+	tests := []struct {
+		field string
+		set   func(*Options)
+	}{
+		{"PageSize", func(o *Options) { o.PageSize = 1000 }},
+		{"PageSize", func(o *Options) { o.PageSize = 64 * 1024 }},
+		{"MemTableSize", func(o *Options) { o.MemTableSize = 1 }},
+		{"SstableSize", func(o *Options) { o.SstableSize = o.PageSize - 1 }},
+		{"SizeMultiple", func(o *Options) { o.SizeMultiple = 1 }},
+		{"MaxLevels", func(o *Options) { o.MaxLevels = 1 }},
+		{"AvgKeySize", func(o *Options) { o.AvgKeySize = -1 }},
+		{"FalsePositiveProb", func(o *Options) { o.FalsePositiveProb = 1 }},
+		{"PageCacheSize", func(o *Options) { o.PageCacheSize = -1 }},
+		{"SyncInterval", func(o *Options) { o.SyncInterval = -1 }},
+		{"WalSegmentSize", func(o *Options) { o.WalSegmentSize = o.PageSize / 2 }},
+		{"WalRecovery", func(o *Options) { o.WalRecovery = SkipCorruptedRecords + 1 }},
+		{"HistoryRetention", func(o *Options) { o.HistoryRetention = -1 }},
+		{"MaxImmutableMemtables", func(o *Options) { o.MaxImmutableMemtables = -1 }},
+		{"LockStripes", func(o *Options) { o.LockStripes = -1 }},
+		{"LockTimeout", func(o *Options) { o.LockTimeout = -1 }},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		tt.set(opts)
+		var optErr *OptionsError
+		if err := opts.validate(); !errors.As(err, &optErr) || optErr.Field != tt.field {
+			t.Errorf("Expected invalid %s, got %v", tt.field, err)
+		}
+		// OpenDB rejects them before touching dir
+		if _, err := OpenDB(filepath.Join(t.TempDir(), "db"), opts); !errors.As(err, &optErr) {
+			t.Errorf("Expected OpenDB to reject %s, got %v", tt.field, err)
+		}
+	}
+}
+
+func TestOptionsCompatible(t *testing.T) {
+	dir := t.TempDir()
+	DB := openTestDB(t, dir, nil)
+	DB.Put(testKey(1), testValue(1), nil)
+	DB.Close()
+
+	tests := []struct {
+		field string
+		opts  *Options
+	}{
+		{"PageSize", &Options{PageSize: 8192}},
+		{"MaxLevels", &Options{MaxLevels: 3}},
+		{"DisableCompression", &Options{DisableCompression: true}},
+	}
+	for _, tt := range tests {
+		var optErr *OptionsError
+		if _, err := OpenDB(dir, tt.opts); !errors.As(err, &optErr) || optErr.Field != tt.field {
+			t.Errorf("Expected incompatible %s, got %v", tt.field, err)
+		}
+	}
+
+	// more levels and other options can change
+	DB = openTestDB(t, dir, &Options{MaxLevels: 8, MemTableSize: 128 * 1024})
+	checkRead(t, DB, testKey(1), testValue(1))
+	DB.Close()
+
+	os.WriteFile(filepath.Join(dir, OptionsFile), []byte("FormatVersion=0\n"), 0644)
+	if _, err := OpenDB(dir, nil); err != ErrFormatVersion {
+		t.Errorf("Expected ErrFormatVersion, got %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, OptionsFile), []byte("PageSize\n"), 0644)
+	if _, err := OpenDB(dir, nil); err != ErrCorruptOptions {
+		t.Errorf("Expected ErrCorruptOptions, got %v", err)
+	}
+}
+
+func TestOptionsFile(t *testing.T) {
+	dir := t.TempDir()
+	opts := (&Options{PageSize: 1024, MaxLevels: 4, DisableCompression: true, WalSegmentSize: 8192}).withDefaults()
+	if err := writeOptions(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := readOptions(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for field, want := range map[string]string{
+		"PageSize":           "1024",
+		"MaxLevels":          "4",
+		"DisableCompression": "true",
+		"WalSegmentSize":     "8192",
+		"MemTableSize":       "65536",
+	} {
+		if stored[field] != want {
+			t.Errorf("%s: expected %s, got %q", field, want, stored[field])
+		}
+	}
+	if err := opts.checkCompatible(stored); err != nil {
+		t.Errorf("Expected stored options to match, got %v", err)
+	}
+
+	// no file yet
+	if stored, err := readOptions(t.TempDir()); stored != nil || err != nil {
+		t.Errorf("Expected no stored options, got %v %v", stored, err)
+	}
+}
+
+func TestOptionsPermission(t *testing.T) {
+	dir := t.TempDir()
+	DB := openTestDB(t, dir, &Options{Permission: 0600})
+	DB.Put(testKey(1), testValue(1), nil)
+	DB.Close()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0600 {
+			t.Errorf("%s: expected mode 0600, got %v", e.Name(), perm)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package page
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+const cacheShards = 16
+
+// Cache holds whole pages of many files in memory
+// keyed by file id and page number. it is split into shards
+// each one bounded to capacity/cacheShards bytes.
+//
+// shards evict with CLOCK: a hit sets the entry ref bit and
+// the hand clears it, evicting the first entry found without it.
+// entries pinned by readers are never evicted
+type Cache struct {
+	shards    [cacheShards]cacheShard
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Size      int // bytes of cached pages
+}
+
+type cacheKey struct {
+	file uint64
+	page uint32
+}
+
+type cacheEntry struct {
+	key      cacheKey
+	buf      []byte // page as on disk (header + data)
+	pins     int32
+	ref      bool
+	cached   bool
+	verified atomic.Bool // checksum was checked
+}
+
+type cacheShard struct {
+	mu       sync.Mutex
+	entries  map[cacheKey]*cacheEntry
+	ring     []*cacheEntry // clock order
+	hand     int
+	size     int
+	capacity int
+}
+
+// buffers of evicted pages and uncached reads
+var bufPool sync.Pool
+
+func getBuf(size int) []byte {
+	if b, ok := bufPool.Get().(*[]byte); ok && cap(*b) >= size {
+		return (*b)[:size]
+	}
+	return make([]byte, size)
+}
+
+func putBuf(b []byte) {
+	bufPool.Put(&b)
+}
+
+// NewCache returns a cache of capacity bytes
+// it may be shared by pages of different files
+func NewCache(capacity int) *Cache {
+	c := &Cache{}
+	for i := range c.shards {
+		c.shards[i].entries = make(map[cacheKey]*cacheEntry)
+		c.shards[i].capacity = capacity / cacheShards
+	}
+	return c
+}
+
+func (c *Cache) Stats() CacheStats {
+	stats := CacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		stats.Size += s.size
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+func (c *Cache) shard(k cacheKey) *cacheShard {
+	h := k.file*0x9E3779B97F4A7C15 ^ uint64(k.page)*0xC2B2AE3D27D4EB4F
+	return &c.shards[(h>>32)%cacheShards]
+}
+
+// pin returns the cached page pinned (nil if missing)
+func (c *Cache) pin(k cacheKey) *cacheEntry {
+	s := c.shard(k)
+	s.mu.Lock()
+	e, ok := s.entries[k]
+	if ok {
+		e.pins++
+		e.ref = true
+	}
+	s.mu.Unlock()
+
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return e
+}
+
+func (c *Cache) unpin(e *cacheEntry) {
+	s := c.shard(e.key)
+	s.mu.Lock()
+	e.pins--
+	s.mu.Unlock()
+}
+
+// insert buf as page k and return it pinned
+// if a racing reader inserted it first its entry is used.
+// a page that can't fit (shard full of pinned pages)
+// is returned without being cached
+func (c *Cache) insert(k cacheKey, buf []byte, verified bool) *cacheEntry {
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[k]; ok {
+		e.pins++
+		putBuf(buf)
+		return e
+	}
+	e := &cacheEntry{key: k, buf: buf, pins: 1}
+	e.verified.Store(verified)
+
+	// every entry is visited at most twice
+	// (once to clear its ref bit and once to evict it)
+	for n := 2 * len(s.ring); n > 0 && s.size+len(buf) > s.capacity; n-- {
+		s.hand %= len(s.ring)
+		v := s.ring[s.hand]
+		if v.pins > 0 || v.ref {
+			v.ref = false
+			s.hand++
+			continue
+		}
+		s.remove(s.hand)
+		c.evictions.Add(1)
+	}
+	if s.size+len(buf) > s.capacity {
+		return e
+	}
+
+	// behind the hand so it is visited last
+	e.cached = true
+	s.hand = min(s.hand, len(s.ring))
+	s.ring = slices.Insert(s.ring, s.hand, e)
+	s.hand++
+	s.entries[k] = e
+	s.size += len(buf)
+	return e
+}
+
+// remove unpinned entry at ring position i
+func (s *cacheShard) remove(i int) {
+	e := s.ring[i]
+	delete(s.entries, e.key)
+	s.ring = slices.Delete(s.ring, i, i+1)
+	s.size -= len(e.buf)
+	if i < s.hand {
+		s.hand--
+	}
+	putBuf(e.buf)
+}
+
+// drop unpinned pages of file
+func (c *Cache) drop(file uint64) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for j := 0; j < len(s.ring); {
+			if e := s.ring[j]; e.key.file == file && e.pins == 0 {
+				s.remove(j)
+				continue
+			}
+			j++
+		}
+		s.mu.Unlock()
+	}
+}
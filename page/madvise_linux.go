@@ -0,0 +1,14 @@
+package page
+
+import "syscall"
+
+func madvise(data []byte, access Access) error {
+	advice := syscall.MADV_NORMAL
+	switch access {
+	case AccessRandom:
+		advice = syscall.MADV_RANDOM
+	case AccessSequential:
+		advice = syscall.MADV_SEQUENTIAL
+	}
+	return syscall.Madvise(data, advice)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package page
+
+// hints are only given on linux (syscall has no madvise elsewhere)
+func madvise(data []byte, access Access) error {
+	return nil
+}
@@ -0,0 +1,83 @@
+package page
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var ErrMmapUnsupported = errors.New("mmap is not supported on this platform")
+
+// Access hints the kernel how a mapped file is read
+type Access int
+
+const (
+	AccessNormal     Access = iota
+	AccessRandom            // point lookups
+	AccessSequential        // full scans (e.g. compaction inputs)
+)
+
+// Mmap maps the file read only so Read serves pages without
+// syscalls and returns values that fit in one page without a copy.
+// it must be called once the file is sealed and before it is
+// read concurrently. pages written after it are read with pread.
+//
+// slices returned by Read point into the mapping so they must not be
+// modified and are valid only until Close (which unmaps the file
+// once reads in progress are done)
+func (pg *Page) Mmap(access Access) error {
+	pg.mmapMu.Lock()
+	defer pg.mmapMu.Unlock()
+	size := int64(pg.pageNum.Load()) * int64(pg.pageSize)
+	if size == 0 || pg.mmap != nil {
+		return nil
+	}
+	data, err := mmapFile(pg.file, size)
+	if err != nil {
+		return err
+	}
+	pg.mmap = data
+	return madvise(data, access)
+}
+
+// Advise changes the access hint of a mapped file
+func (pg *Page) Advise(access Access) error {
+	pg.mmapMu.RLock()
+	defer pg.mmapMu.RUnlock()
+	if pg.mmap == nil {
+		return nil
+	}
+	return madvise(pg.mmap, access)
+}
+
+// read the value at pageNum from the mapping
+// (ok is false if its pages are not all mapped)
+// caller must hold mmapMu shared
+func (pg *Page) readMapped(pageNum uint32, verify bool) (data []byte, last uint32, ok bool, err error) {
+	ps := int64(pg.pageSize)
+	first := pageNum
+	for {
+		off := int64(pageNum) * ps
+		if off+ps > int64(len(pg.mmap)) {
+			return nil, 0, false, nil
+		}
+		buf := pg.mmap[off : off+ps]
+		if err := pg.check(pageNum, buf, verify); err != nil {
+			return nil, 0, true, err
+		}
+		h := binary.BigEndian.Uint32(buf[0:4])
+
+		// capped so appends of callers never write into the mapping
+		end := headerSize + int(h>>1)
+		curr := buf[headerSize:end:end]
+		if h&1 == 0 {
+			if pageNum == first {
+				return curr, pageNum, true, nil
+			}
+			return append(data, curr...), pageNum, true, nil
+		}
+
+		// value split over pages is copied to be contiguous
+		data = append(data, curr...)
+		pageNum++
+	}
+}
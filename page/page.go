@@ -2,6 +2,9 @@ package page
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"math"
 	"os"
@@ -14,6 +17,32 @@ import (
 // 1- Add faster way for write (may use worker pools or go routines)
 // 2- Find a way to decrease read func allocations
 
+var (
+	ErrCorruptPage = errors.New("page is corrupted")
+	ErrFileFull    = errors.New("file reached max number of pages")
+)
+
+// ErrCorruption reports a page with a garbage header
+// or a checksum that doesn't match its data
+type ErrCorruption struct {
+	File string
+	Page uint32
+}
+
+func (e *ErrCorruption) Error() string {
+	return fmt.Sprintf("page %d of %s is corrupted", e.Page, e.File)
+}
+
+// every corruption matches ErrCorruptPage with errors.Is
+func (e *ErrCorruption) Is(target error) bool {
+	return target == ErrCorruptPage
+}
+
+// size word + checksum
+const headerSize = 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 type Page struct {
 	file     *os.File // Underline OS file
 	close    chan struct{}
@@ -22,8 +51,14 @@ type Page struct {
 	pageNum  atomic.Uint32   // Number of pages (filesize/pagesize)
 	pageSize uint16          // Size of Page (up to 64KB)
 	fsync    bool            // fsync or not
+	id       uint64          // unique file id (key of cached pages)
+	cache    *Cache          // nil if reads are not cached
+	mmap     []byte          // read only mapping of sealed file (nil if not mapped)
+	mmapMu   sync.RWMutex    // held shared while the mapping is read so Close can't unmap it
 }
 
+var fileIDs atomic.Uint64
+
 // Open/Create page for specific data
 func InitPage(name string, flag int, perm os.FileMode, pageSize uint16, fsync bool, syncInterval time.Duration) (*Page, error) {
 	file, err := os.OpenFile(name, flag, perm)
@@ -34,8 +69,13 @@ func InitPage(name string, flag int, perm os.FileMode, pageSize uint16, fsync bo
 		file:     file,
 		pageSize: pageSize,
 		close:    make(chan struct{}),
+		id:       fileIDs.Add(1),
 	}
 	pg.wg = &sync.WaitGroup{}
+	if err := pg.recover(flag&(os.O_WRONLY|os.O_RDWR) != 0); err != nil {
+		file.Close()
+		return nil, err
+	}
 	if fsync {
 		pg.fsync = true
 		go pg.syncProcess(syncInterval)
@@ -43,6 +83,49 @@ func InitPage(name string, flag int, perm os.FileMode, pageSize uint16, fsync bo
 	return pg, nil
 }
 
+// recover page count of existing data
+// a write torn by a crash leaves a partial page or a value
+// whose last pages are missing at the end of the file.
+// they are cut off (truncated if writable) so new
+// writes append right after the last complete value
+func (pg *Page) recover(writable bool) error {
+	info, err := pg.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	n := uint32(size / int64(pg.pageSize))
+
+	for n > 0 {
+		// checksums are left to Read so bit rot
+		// in the last page is reported, not cut off
+		e, err := pg.getPage(n-1, false)
+		if err != nil && !errors.Is(err, ErrCorruptPage) && err != io.EOF {
+			return err
+		}
+		var h uint32
+		if err == nil {
+			h = binary.BigEndian.Uint32(e.buf[0:4])
+			pg.release(e)
+		}
+
+		// last page must end a value with a sane size.
+		// pages of a value cut off before its end still
+		// have the overflow bit so they are dropped too
+		if err == nil && h&1 == 0 {
+			break
+		}
+		n--
+	}
+	pg.pageNum.Store(n)
+
+	end := int64(n) * int64(pg.pageSize)
+	if writable && end != size {
+		return pg.file.Truncate(end)
+	}
+	return nil
+}
+
 func (pg *Page) syncProcess(syncInterval time.Duration) {
 	pg.wg.Add(1)
 	defer pg.wg.Done()
@@ -67,10 +150,11 @@ func (pg *Page) Write(data []byte) (uint32, error) {
 	/*
 		PAGE LAYOUT
 
-		----------------------------------
-		| DataSize | overflow | Data     |
-		| 0 - 30   |  31 	  | 32 - end |
-		----------------------------------
+		---------------------------------------------
+		| DataSize | overflow | CRC      | Data     |
+		| 0 - 30   |  31 	  | 32 - 63  | 64 - end |
+		---------------------------------------------
+		CRC is CRC32C of the first 4 bytes and Data
 	*/
 
 	/*
@@ -90,36 +174,38 @@ func (pg *Page) Write(data []byte) (uint32, error) {
 	// despite of size of data size
 	buf := make([]byte, pg.pageSize)
 	// Data fits in One Page
-	if len(data)+4 <= int(pg.pageSize) {
+	if len(data)+headerSize <= int(pg.pageSize) {
 
-		newP = pg.newPage(1) - 1
-		off := int64(newP * uint32(pg.pageSize))
-		header := len(data) << 1
+		newP, err = pg.newPage(1)
+		if err != nil {
+			return 0, err
+		}
+		off := int64(newP) * int64(pg.pageSize)
 
-		binary.BigEndian.PutUint32(buf[0:], uint32(header))
-		copy(buf[4:], data)
-		pg.file.WriteAt(buf, off)
+		encodePage(buf, data, false)
+		_, err = pg.file.WriteAt(buf, off)
+		if err != nil {
+			return 0, err
+		}
 
 	} else {
 
 		// split Data
 		curr := 0
-		n := int(math.Ceil(float64(len(data)) / float64(pg.pageSize-4)))
-		newP = pg.newPage(uint32(n)) - uint32(n)
+		n := int(math.Ceil(float64(len(data)) / float64(pg.pageSize-headerSize)))
+		newP, err = pg.newPage(uint32(n))
+		if err != nil {
+			return 0, err
+		}
 
 		// start filling the pages
 		for i := range n {
 			pgNum := newP + uint32(i)
-			off := int64(pgNum * uint32(pg.pageSize))
+			off := int64(pgNum) * int64(pg.pageSize)
 
-			x := min(int(pg.pageSize-4), len(data)-curr)
+			x := min(int(pg.pageSize-headerSize), len(data)-curr)
 
-			header := x<<1 | 1
-			if i == n-1 {
-				header = header & ^1
-			}
-			binary.BigEndian.PutUint32(buf[0:], uint32(header))
-			copy(buf[4:], data[curr:curr+x])
+			encodePage(buf, data[curr:curr+x], i != n-1)
 			curr += x
 			_, err = pg.file.WriteAt(buf, off)
 			if err != nil {
@@ -131,39 +217,195 @@ func (pg *Page) Write(data []byte) (uint32, error) {
 	return newP, nil
 }
 
-// Read the data started from this pageNum
-// (Thread Safe)
-func (pg *Page) Read(pageNum uint16) ([]byte, uint16, error) {
+// WriteAll writes all records as one contiguous run of pages
+// with a single WriteAt and returns pgNum of each one
+// (thread safe)
+func (pg *Page) WriteAll(records [][]byte) ([]uint32, error) {
+	pg.wg.Add(1)
+	defer pg.wg.Done()
 
-	var data []byte
-	header := make([]byte, 4)
-	var err error
-	for {
+	// same layout as Write. a record takes at least one page
+	space := int(pg.pageSize - headerSize)
+	pages := make([]int, len(records))
+	total := 0
+	for i, data := range records {
+		pages[i] = max(1, int(math.Ceil(float64(len(data))/float64(space))))
+		total += pages[i]
+	}
+	start, err := pg.newPage(uint32(total))
+	if err != nil {
+		return nil, err
+	}
 
-		off := int64(pageNum) * int64(pg.pageSize)
-		_, err = pg.file.ReadAt(header, off)
-		if err != nil {
-			return nil, 0, err
+	buf := make([]byte, total*int(pg.pageSize))
+	pgNums := make([]uint32, len(records))
+	p := 0
+	for i, data := range records {
+		pgNums[i] = start + uint32(p)
+		curr := 0
+		for j := range pages[i] {
+			page := buf[p*int(pg.pageSize) : (p+1)*int(pg.pageSize)]
+			x := min(space, len(data)-curr)
+			encodePage(page, data[curr:curr+x], j != pages[i]-1)
+			curr += x
+			p++
 		}
+	}
+
+	_, err = pg.file.WriteAt(buf, int64(start)*int64(pg.pageSize))
+	if err != nil {
+		return nil, err
+	}
+	return pgNums, nil
+}
+
+// fill page buf with data and its header
+func encodePage(buf, data []byte, overflow bool) {
+	header := uint32(len(data)) << 1
+	if overflow {
+		header |= 1
+	}
+	binary.BigEndian.PutUint32(buf[0:4], header)
+	copy(buf[headerSize:], data)
+	binary.BigEndian.PutUint32(buf[4:8], checksum(buf[0:4], data))
+}
+
+// CRC32C of the size word and data
+func checksum(header, data []byte) uint32 {
+	return crc32.Update(crc32.Checksum(header, crcTable), crcTable, data)
+}
 
-		h := binary.BigEndian.Uint32(header)
+// SetCache makes reads of pg go through c
+// (must be called before pg is used)
+func (pg *Page) SetCache(c *Cache) {
+	pg.cache = c
+}
 
-		curr := make([]byte, h>>1)
+// Read the data started from this pageNum
+// pages are verified against their checksum
+// returns *ErrCorruption if one doesn't match
+// (Thread Safe)
+func (pg *Page) Read(pageNum uint32) ([]byte, uint32, error) {
+	return pg.read(pageNum, true)
+}
 
-		_, err = pg.file.ReadAt(curr, off+4)
-		if err != nil && err != io.EOF {
+// ReadUnverified is Read without the checksum check
+// (a garbage header is still reported)
+func (pg *Page) ReadUnverified(pageNum uint32) ([]byte, uint32, error) {
+	return pg.read(pageNum, false)
+}
+
+func (pg *Page) read(pageNum uint32, verify bool) ([]byte, uint32, error) {
+	pg.mmapMu.RLock()
+	if pg.mmap != nil {
+		if data, last, ok, err := pg.readMapped(pageNum, verify); ok {
+			pg.mmapMu.RUnlock()
+			return data, last, err
+		}
+	}
+	pg.mmapMu.RUnlock()
+
+	// pin all pages of the value first
+	// so data is allocated once with its exact size
+	var local [4]*cacheEntry
+	pages := local[:0]
+	defer func() {
+		for _, e := range pages {
+			pg.release(e)
+		}
+	}()
+
+	size := 0
+	for {
+		e, err := pg.getPage(pageNum, verify)
+		if err != nil {
 			return nil, 0, err
 		}
-		data = append(data, curr...)
+		pages = append(pages, e)
+		h := binary.BigEndian.Uint32(e.buf[0:4])
+		size += int(h >> 1)
 		if (h & 1) == 0 {
 			break
 		}
 		pageNum++
 	}
+
+	data := make([]byte, 0, size)
+	for _, e := range pages {
+		h := binary.BigEndian.Uint32(e.buf[0:4])
+		data = append(data, e.buf[headerSize:headerSize+h>>1]...)
+	}
 	return data, pageNum, nil
 
 }
 
+// getPage returns page pageNum pinned until release
+// the whole page is read with one ReadAt on a cache miss
+func (pg *Page) getPage(pageNum uint32, verify bool) (*cacheEntry, error) {
+	key := cacheKey{file: pg.id, page: pageNum}
+	if pg.cache != nil {
+		if e := pg.cache.pin(key); e != nil {
+			if verify && !e.verified.Load() {
+				if err := pg.check(pageNum, e.buf, true); err != nil {
+					pg.cache.unpin(e)
+					return nil, err
+				}
+				e.verified.Store(true)
+			}
+			return e, nil
+		}
+	}
+
+	buf := getBuf(int(pg.pageSize))
+	n, err := pg.file.ReadAt(buf, int64(pageNum)*int64(pg.pageSize))
+	if n < headerSize && err == nil {
+		err = io.EOF
+	}
+	if err != nil && (err != io.EOF || n < headerSize) {
+		putBuf(buf)
+		return nil, err
+	}
+	buf = buf[:n]
+	if err := pg.check(pageNum, buf, verify); err != nil {
+		putBuf(buf)
+		return nil, err
+	}
+	if pg.cache == nil {
+		return &cacheEntry{buf: buf}, nil
+	}
+	return pg.cache.insert(key, buf, verify), nil
+}
+
+// check the header describes data inside buf
+// and (if verify) its checksum
+func (pg *Page) check(pageNum uint32, buf []byte, verify bool) error {
+	h := binary.BigEndian.Uint32(buf[0:4])
+	size := int(h >> 1)
+
+	// torn or garbage header
+	if size > int(pg.pageSize-headerSize) || headerSize+size > len(buf) {
+		return &ErrCorruption{File: pg.file.Name(), Page: pageNum}
+	}
+	if verify && checksum(buf[0:4], buf[headerSize:headerSize+size]) != binary.BigEndian.Uint32(buf[4:8]) {
+		return &ErrCorruption{File: pg.file.Name(), Page: pageNum}
+	}
+	return nil
+}
+
+// unpin page got by getPage
+func (pg *Page) release(e *cacheEntry) {
+	if e.cached {
+		pg.cache.unpin(e)
+		return
+	}
+	putBuf(e.buf)
+}
+
+// Sync flush written pages to disk
+func (pg *Page) Sync() error {
+	return pg.file.Sync()
+}
+
 func (pg *Page) Close() error {
 
 	if !pg.IsClosed.CompareAndSwap(false, true) {
@@ -180,7 +422,20 @@ func (pg *Page) Close() error {
 	// wait everything to be Done
 	pg.wg.Wait()
 
-	err := pg.file.Close()
+	// pages of a closed file are never read again
+	if pg.cache != nil {
+		pg.cache.drop(pg.id)
+	}
+	// wait for readers still inside the mapping
+	var err error
+	pg.mmapMu.Lock()
+	if pg.mmap != nil {
+		err = munmap(pg.mmap)
+		pg.mmap = nil
+	}
+	pg.mmapMu.Unlock()
+
+	err = errors.Join(err, pg.file.Close())
 	if err != nil {
 		return err
 	}
@@ -188,8 +443,8 @@ func (pg *Page) Close() error {
 	return nil
 }
 
-// Return New PageNum after allocating pages atomically
-func (pg *Page) newPage(delta uint32) uint32 {
+// Return first PageNum of delta pages allocated atomically
+func (pg *Page) newPage(delta uint32) (uint32, error) {
 
 	/*
 	  Instead of allocating one page at the time
@@ -197,17 +452,40 @@ func (pg *Page) newPage(delta uint32) uint32 {
 	  this brings better data locality when reading some
 	  data sits in more than one page
 	*/
-	return pg.pageNum.Add(delta)
+	for {
+		curr := pg.pageNum.Load()
+
+		// page numbers are 32 bits. never wrap around
+		if curr > math.MaxUint32-delta {
+			return 0, ErrFileFull
+		}
+		if pg.pageNum.CompareAndSwap(curr, curr+delta) {
+			return curr, nil
+		}
+	}
+}
+
+// Truncate drops pages from pageNum to the end
+// (no reader or writer may use them)
+func (pg *Page) Truncate(pageNum uint32) error {
+	if pageNum >= pg.pageNum.Load() {
+		return nil
+	}
+	pg.pageNum.Store(pageNum)
+	if pg.cache != nil {
+		pg.cache.drop(pg.id)
+	}
+	return pg.file.Truncate(int64(pageNum) * int64(pg.pageSize))
 }
 
 func (pg *Page) GetLastPage() uint32 {
 	return pg.pageNum.Load()
 }
 
-func (pg *Page) Size() uint32 {
+func (pg *Page) Size() uint64 {
 
 	// estimation of Page curr size
-	return pg.pageNum.Load() * uint32(pg.pageSize)
+	return uint64(pg.pageNum.Load()) * uint64(pg.pageSize)
 }
 
 /*
@@ -233,17 +511,24 @@ func (it *Iterator) Next() uint32 {
 	return it.currNum.Load()
 }
 
+// Seek points Iterator to the value starting at pgNum
+func (it *Iterator) Seek(pgNum uint32) {
+	it.currNum.Store(pgNum)
+}
+
 func (it *Iterator) Valid() bool {
 	// current pageNum in page struct
-	return it.currNum.Load() <= it.pg.pageNum.Load()
+	return it.currNum.Load() < it.pg.pageNum.Load()
 }
 
 // return Curr value
-func (it *Iterator) Get(pgNum uint16) ([]byte, error) {
+func (it *Iterator) Get(pgNum uint32) ([]byte, error) {
 	data, newPgNum, err := it.pg.Read(pgNum)
 	if err != nil {
 		return nil, err
 	}
-	it.currNum.Store(uint32(newPgNum))
+
+	// next value starts after the last page of this one
+	it.currNum.Store(newPgNum + 1)
 	return data, nil
 }
@@ -2,6 +2,8 @@ package page
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 	"sync"
@@ -75,7 +77,7 @@ func TestReadWrite(t *testing.T) {
 		t.Errorf("Write failed: %v", err)
 	}
 
-	readData, _, err := pg.Read(uint16(pageNum))
+	readData, _, err := pg.Read(pageNum)
 	if err != nil {
 		t.Errorf("Read failed: %v", err)
 	}
@@ -100,7 +102,7 @@ func TestEmptyData(t *testing.T) {
 		t.Fatalf("Write data failed: %v", err)
 	}
 
-	readData, _, err := pg.Read(uint16(pageNum))
+	readData, _, err := pg.Read(pageNum)
 	if err != nil {
 		t.Fatalf("Read data failed: %v", err)
 	}
@@ -142,7 +144,7 @@ func TestIterator(t *testing.T) {
 		t.Error("Iterator should be valid initially")
 	}
 
-	readData, err := it.Get(uint16(pageNum))
+	readData, err := it.Get(pageNum)
 	if err != nil {
 		t.Errorf("Iterator Get failed: %v", err)
 	}
@@ -211,7 +213,7 @@ func TestConcurrentReadWrite(t *testing.T) {
 	for res := range results {
 		go func(res writeResult) {
 			defer wg.Done()
-			readData, _, err := pg.Read(uint16(res.pageNum))
+			readData, _, err := pg.Read(res.pageNum)
 			if err != nil {
 				t.Errorf("Concurrent read failed for page %d: %v", res.pageNum, err)
 				return
@@ -283,7 +285,7 @@ func BenchmarkRead(b *testing.B) {
 	b.SetParallelism(4)
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			_, _, err := pg.Read(uint16(pageNums[i%numPages]))
+			_, _, err := pg.Read(pageNums[i%numPages])
 			if err != nil {
 				b.Errorf("Read failed: %v", err)
 			}
@@ -323,7 +325,7 @@ func BenchmarkReadWrite(b *testing.B) {
 				}
 			} else {
 				// if i%numPages is not intiallized. it will read page 0
-				_, _, err := pg.Read(uint16(pageNums[i%numPages]))
+				_, _, err := pg.Read(pageNums[i%numPages])
 				if err != nil {
 					b.Errorf("Read failed: %v", err)
 				}
@@ -332,3 +334,558 @@ func BenchmarkReadWrite(b *testing.B) {
 		}
 	})
 }
+
+func TestIteratorAllValues(t *testing.T) {
+	tempFile := "test.db"
+	defer os.Remove(tempFile)
+
+	pg, err := InitPage(tempFile, os.O_CREATE|os.O_RDWR, 0644, 512, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Close()
+
+	values := [][]byte{
+		[]byte("first"),
+		bytes.Repeat([]byte("x"), 2000), // overflow pages
+		[]byte("last"),
+	}
+	for _, v := range values {
+		if _, err := pg.Write(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it := Newiterator(pg)
+	i := 0
+	for ; it.Valid(); i++ {
+		data, err := it.Get(it.Next())
+		if err != nil {
+			t.Fatalf("Iterator Get failed: %v", err)
+		}
+		if i >= len(values) || !bytes.Equal(data, values[i]) {
+			t.Fatalf("Iterator data mismatch at value %d", i)
+		}
+	}
+	if i != len(values) {
+		t.Errorf("Expected %d values, got %d", len(values), i)
+	}
+}
+
+func TestCorruptHeader(t *testing.T) {
+	tempFile := "test.db"
+	defer os.Remove(tempFile)
+
+	pg, err := InitPage(tempFile, os.O_CREATE|os.O_RDWR, 0644, 512, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Close()
+
+	pgNum, _ := pg.Write([]byte("data"))
+	pg.file.WriteAt([]byte{0xFF, 0xFF, 0xFF, 0xFE}, int64(pgNum)*512)
+
+	_, _, err = pg.Read(pgNum)
+	var corrupt *ErrCorruption
+	if !errors.As(err, &corrupt) || !errors.Is(err, ErrCorruptPage) {
+		t.Fatalf("Expected ErrCorruption, got %v", err)
+	}
+	if corrupt.File != tempFile || corrupt.Page != pgNum {
+		t.Errorf("Expected corruption at page %d of %s, got %v", pgNum, tempFile, corrupt)
+	}
+}
+
+func TestWriteAll(t *testing.T) {
+	tempFile := "test.db"
+	defer os.Remove(tempFile)
+
+	pg, err := InitPage(tempFile, os.O_CREATE|os.O_RDWR, 0644, 512, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Close()
+
+	records := [][]byte{
+		[]byte("first"),
+		{},
+		bytes.Repeat([]byte("x"), 1500), // overflow pages
+		[]byte("last"),
+	}
+	pgNums, err := pg.WriteAll(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pg.GetLastPage() != 6 {
+		t.Errorf("Expected 6 pages, got %d", pg.GetLastPage())
+	}
+	for i, pgNum := range pgNums {
+		data, _, err := pg.Read(pgNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, records[i]) {
+			t.Errorf("Data mismatch at record %d", i)
+		}
+	}
+}
+
+func TestReopen(t *testing.T) {
+	tempFile := "test.db"
+	defer os.Remove(tempFile)
+
+	pg, err := InitPage(tempFile, os.O_CREATE|os.O_RDWR, 0644, 512, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := pg.Write([]byte("first"))
+	big, _ := pg.Write(bytes.Repeat([]byte("x"), 1500))
+	pg.Close()
+
+	// torn write: an overflow page without the rest of its value
+	// and a partial page
+	f, _ := os.OpenFile(tempFile, os.O_WRONLY|os.O_APPEND, 0644)
+	torn := make([]byte, 512+100)
+	binary.BigEndian.PutUint32(torn, 508<<1|1)
+	f.Write(torn)
+	f.Close()
+
+	pg, err = InitPage(tempFile, os.O_RDWR, 0644, 512, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Close()
+
+	if pg.GetLastPage() != 4 {
+		t.Errorf("Expected 4 pages, got %d", pg.GetLastPage())
+	}
+	if info, _ := os.Stat(tempFile); info.Size() != 4*512 {
+		t.Errorf("Expected torn pages truncated, size %d", info.Size())
+	}
+
+	last, err := pg.Write([]byte("last"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != 4 {
+		t.Errorf("Expected append at page 4, got %d", last)
+	}
+	for pgNum, want := range map[uint32][]byte{
+		first: []byte("first"),
+		big:   bytes.Repeat([]byte("x"), 1500),
+		last:  []byte("last"),
+	} {
+		data, _, err := pg.Read(pgNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("Data mismatch at page %d", pgNum)
+		}
+	}
+}
+
+func TestPageNumBeyond16Bits(t *testing.T) {
+	tempFile := "test.db"
+	defer os.Remove(tempFile)
+
+	pg, err := InitPage(tempFile, os.O_CREATE|os.O_RDWR, 0644, 256, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Close()
+
+	// fill the first 2^16 pages
+	records := make([][]byte, 1<<16)
+	for i := range records {
+		records[i] = []byte(fmt.Sprintf("record-%d", i))
+	}
+	if _, err := pg.WriteAll(records); err != nil {
+		t.Fatal(err)
+	}
+
+	big := bytes.Repeat([]byte("x"), 1000)
+	pgNum, err := pg.Write(big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pgNum != 1<<16 {
+		t.Fatalf("Expected page %d, got %d", 1<<16, pgNum)
+	}
+	if pg.Size() != uint64(pg.GetLastPage())*256 {
+		t.Errorf("Unexpected size %d", pg.Size())
+	}
+
+	data, last, err := pg.Read(pgNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, big) || last != pg.GetLastPage()-1 {
+		t.Errorf("Data mismatch at page %d (last %d)", pgNum, last)
+	}
+	data, _, err = pg.Read(5)
+	if err != nil || string(data) != "record-5" {
+		t.Errorf("Data mismatch at page 5: %q %v", data, err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	tempFile := "test.db"
+	defer os.Remove(tempFile)
+
+	pg, err := InitPage(tempFile, os.O_CREATE|os.O_RDWR, 0644, 512, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Close()
+
+	first, _ := pg.Write([]byte("first"))
+	big, _ := pg.Write(bytes.Repeat([]byte("x"), 1500))
+
+	// flip one data bit in the second page of the big value
+	pg.file.WriteAt([]byte{'y'}, int64(big+1)*512+100)
+
+	if data, _, err := pg.Read(first); err != nil || string(data) != "first" {
+		t.Fatalf("Expected intact page, got %q %v", data, err)
+	}
+	_, _, err = pg.Read(big)
+	var corrupt *ErrCorruption
+	if !errors.As(err, &corrupt) || corrupt.Page != big+1 {
+		t.Fatalf("Expected corruption at page %d, got %v", big+1, err)
+	}
+
+	// unverified reads return the data as is
+	data, _, err := pg.ReadUnverified(big)
+	if err != nil || len(data) != 1500 || bytes.Count(data, []byte("y")) != 1 {
+		t.Errorf("Unexpected unverified read %v", err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	tempFile := "test.db"
+	defer os.Remove(tempFile)
+
+	pg, err := InitPage(tempFile, os.O_CREATE|os.O_RDWR, 0644, 512, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Close()
+
+	// room for 2 pages per shard
+	cache := NewCache(2 * 512 * cacheShards)
+	pg.SetCache(cache)
+
+	pageNums := make([]uint32, 200)
+	for i := range pageNums {
+		pageNums[i], _ = pg.Write([]byte(fmt.Sprintf("value-%d", i)))
+	}
+	for round := range 2 {
+		for i, pgNum := range pageNums {
+			data, _, err := pg.Read(pgNum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != fmt.Sprintf("value-%d", i) {
+				t.Fatalf("Data mismatch at page %d in round %d", pgNum, round)
+			}
+		}
+	}
+
+	stats := cache.Stats()
+	if stats.Hits+stats.Misses != 400 || stats.Evictions == 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if stats.Size > 2*512*cacheShards {
+		t.Errorf("Cache exceeded its capacity %+v", stats)
+	}
+
+	// hot page stays cached
+	before := cache.Stats().Hits
+	for range 10 {
+		pg.Read(pageNums[0])
+	}
+	if cache.Stats().Hits-before < 9 {
+		t.Errorf("Expected hits on a hot page, got %d", cache.Stats().Hits-before)
+	}
+}
+
+func TestCachePin(t *testing.T) {
+	cache := NewCache(512 * cacheShards)
+	key := cacheKey{file: 1, page: 0}
+	s := cache.shard(key)
+
+	e := cache.insert(key, make([]byte, 512), true)
+	if !e.cached {
+		t.Fatal("Expected page to be cached")
+	}
+
+	// another page of the same shard can't evict the pinned one
+	other := cacheKey{file: 1, page: 1}
+	for cache.shard(other) != s {
+		other.page++
+	}
+	o := cache.insert(other, make([]byte, 512), true)
+	if o.cached {
+		t.Error("Expected pinned page to stay cached")
+	}
+	if cache.pin(key) != e {
+		t.Error("Expected pinned page to be found")
+	}
+	cache.unpin(e)
+	cache.unpin(e)
+
+	// once unpinned it can be evicted
+	o = cache.insert(other, make([]byte, 512), true)
+	if !o.cached || cache.pin(key) != nil {
+		t.Error("Expected unpinned page to be evicted")
+	}
+	cache.unpin(o)
+
+	cache.drop(1)
+	if cache.Stats().Size != 0 {
+		t.Errorf("Expected empty cache after drop, got %+v", cache.Stats())
+	}
+}
+
+func TestCacheChecksum(t *testing.T) {
+	tempFile := "test.db"
+	defer os.Remove(tempFile)
+
+	pg, err := InitPage(tempFile, os.O_CREATE|os.O_RDWR, 0644, 512, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Close()
+	pg.SetCache(NewCache(1 << 20))
+
+	pgNum, _ := pg.Write([]byte("data"))
+	pg.file.WriteAt([]byte{'x'}, int64(pgNum)*512+headerSize)
+
+	// page cached by an unverified read is still checked by Read
+	if _, _, err := pg.ReadUnverified(pgNum); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := pg.Read(pgNum); !errors.Is(err, ErrCorruptPage) {
+		t.Errorf("Expected ErrCorruption, got %v", err)
+	}
+}
+
+func BenchmarkReadCached(b *testing.B) {
+	tempFile := "bench.db"
+	defer os.Remove(tempFile)
+
+	pg, err := InitPage(tempFile, os.O_CREATE|os.O_RDWR, 0644, 4096, false, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer pg.Close()
+	pg.SetCache(NewCache(16 << 20))
+
+	numPages := 1000
+	pageNums := make([]uint32, numPages)
+	data := make([]byte, 8000)
+	for i := range data {
+		data[i] = byte(i % 256)
+	}
+
+	for i := range pageNums {
+		pageNum, err := pg.Write(data)
+		if err != nil {
+			b.Error(err)
+		}
+		pageNums[i] = pageNum
+	}
+
+	i := 0
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.SetParallelism(4)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, _, err := pg.Read(pageNums[i%numPages])
+			if err != nil {
+				b.Errorf("Read failed: %v", err)
+			}
+			i++
+		}
+	})
+}
+
+func TestMmap(t *testing.T) {
+	tempFile := "test.db"
+	defer os.Remove(tempFile)
+
+	pg, err := InitPage(tempFile, os.O_CREATE|os.O_RDWR, 0644, 512, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Close()
+
+	small, _ := pg.Write([]byte("small"))
+	big, _ := pg.Write(bytes.Repeat([]byte("x"), 1500))
+	if err := pg.Mmap(AccessRandom); err == ErrMmapUnsupported {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	after, _ := pg.Write([]byte("after"))
+
+	data, _, err := pg.Read(small)
+	if err != nil || string(data) != "small" {
+		t.Fatalf("Expected small, got %q %v", data, err)
+	}
+	// single page value points into the mapping
+	if &data[0] != &pg.mmap[int(small)*512+headerSize] {
+		t.Error("Expected zero copy read")
+	}
+	if data = append(data, '!'); pg.mmap[int(small)*512+headerSize+5] == '!' {
+		t.Error("Append wrote into the mapping")
+	}
+
+	data, last, err := pg.Read(big)
+	if err != nil || !bytes.Equal(data, bytes.Repeat([]byte("x"), 1500)) || last != big+2 {
+		t.Errorf("Data mismatch at page %d", big)
+	}
+
+	// pages written after the mapping are read from the file
+	data, _, err = pg.Read(after)
+	if err != nil || string(data) != "after" {
+		t.Errorf("Expected after, got %q %v", data, err)
+	}
+
+	if err := pg.Advise(AccessSequential); err != nil {
+		t.Error(err)
+	}
+	if err := pg.Close(); err != nil || pg.mmap != nil {
+		t.Errorf("Expected file unmapped on close, got %v", err)
+	}
+}
+
+func BenchmarkReadMmap(b *testing.B) {
+	tempFile := "bench.db"
+	defer os.Remove(tempFile)
+
+	pg, err := InitPage(tempFile, os.O_CREATE|os.O_RDWR, 0644, 4096, false, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer pg.Close()
+
+	numPages := 1000
+	pageNums := make([]uint32, numPages)
+	data := make([]byte, 4000)
+	for i := range data {
+		data[i] = byte(i % 256)
+	}
+
+	for i := range pageNums {
+		pageNum, err := pg.Write(data)
+		if err != nil {
+			b.Error(err)
+		}
+		pageNums[i] = pageNum
+	}
+	if err := pg.Mmap(AccessRandom); err != nil {
+		b.Skip(err)
+	}
+
+	i := 0
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.SetParallelism(4)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, _, err := pg.Read(pageNums[i%numPages])
+			if err != nil {
+				b.Errorf("Read failed: %v", err)
+			}
+			i++
+		}
+	})
+}
+
+func TestTruncate(t *testing.T) {
+	tempFile := "test.db"
+	defer os.Remove(tempFile)
+
+	pg, err := InitPage(tempFile, os.O_CREATE|os.O_RDWR, 0644, 512, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Close()
+
+	pg.Write([]byte("small"))
+	big, _ := pg.Write(make([]byte, 1200)) // 3 pages
+	pg.Write([]byte("last"))
+
+	if err := pg.Truncate(big); err != nil {
+		t.Fatal(err)
+	}
+	if pg.GetLastPage() != big {
+		t.Errorf("Expected %d pages, got %d", big, pg.GetLastPage())
+	}
+	if info, _ := os.Stat(tempFile); info.Size() != int64(big)*512 {
+		t.Errorf("Expected file of %d bytes, got %d", big*512, info.Size())
+	}
+
+	// new values reuse the cut pages
+	if pgNum, _ := pg.Write([]byte("new")); pgNum != big {
+		t.Errorf("Expected new value at page %d, got %d", big, pgNum)
+	}
+}
+
+func TestMmapCloseDuringRead(t *testing.T) {
+	tempFile := "test.db"
+	defer os.Remove(tempFile)
+
+	pg, err := InitPage(tempFile, os.O_CREATE|os.O_RDWR, 0644, 512, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// values over pages are copied out of the mapping
+	value := bytes.Repeat([]byte("x"), 1500)
+	var pageNums []uint32
+	for range 100 {
+		pageNum, err := pg.Write(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pageNums = append(pageNums, pageNum)
+	}
+	if err := pg.Mmap(AccessRandom); err == ErrMmapUnsupported {
+		pg.Close()
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	started := make(chan struct{}, 8)
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := w; ; i++ {
+				data, _, err := pg.Read(pageNums[i%len(pageNums)])
+				if i == w {
+					started <- struct{}{}
+				}
+				// reads after Close fail on the closed file
+				if err != nil {
+					return
+				}
+				if !bytes.Equal(data, value) {
+					t.Errorf("Data mismatch at page %d", pageNums[i%len(pageNums)])
+					return
+				}
+			}
+		}()
+	}
+	for range 8 {
+		<-started
+	}
+	if err := pg.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
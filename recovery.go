@@ -0,0 +1,32 @@
+package irisdb
+
+// RecoveryMode decides what OpenDB does with corrupted WAL records
+type RecoveryMode int
+
+const (
+	// drop a corrupted tail of the log (torn last write)
+	// corruption followed by good records fails the open
+	TolerateCorruptedTail RecoveryMode = iota
+
+	// fail the open on any corrupted record
+	AbsoluteConsistency
+
+	// drop every corrupted record and replay the rest
+	SkipCorruptedRecords
+)
+
+// RecoveryReport describes WAL records dropped by the last open
+type RecoveryReport struct {
+	Mode      RecoveryMode
+	Dropped   int
+	Corrupted []WalCorruption
+}
+
+type WalCorruption struct {
+	File   string
+	Offset int64 // byte offset of the record in the file
+}
+
+func (DB *IrisDB) RecoveryReport() RecoveryReport {
+	return DB.recovery
+}
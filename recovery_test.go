@@ -0,0 +1,215 @@
+package irisdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alimx07/IrisDB/page"
+)
+
+// logs of the DB in dir (oldest first)
+func walFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	wals, err := filepath.Glob(filepath.Join(dir, "*"+WalExtension))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wals
+}
+
+// DB with 5 records in log segments of two
+func segmentedDB(t *testing.T) (string, []string) {
+	t.Helper()
+	dir := t.TempDir()
+	DB := openTestDB(t, dir, &Options{WalSegmentSize: 2 * testPageSize})
+	for i := range 5 {
+		if err := DB.Put(testKey(i), testValue(i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wals := walFiles(t, dir)
+	if len(wals) != 3 {
+		t.Fatalf("Expected 3 segments, got %d", len(wals))
+	}
+	return dir, wals
+}
+
+func TestRecoveryTornTail(t *testing.T) {
+	dir, wals := segmentedDB(t)
+
+	// last record of the newest segment is torn
+	corruptPage(t, wals[2], 0)
+	if _, err := OpenDB(dir, &Options{WalRecovery: AbsoluteConsistency}); !errors.Is(err, ErrCorruptWal) {
+		t.Fatalf("AbsoluteConsistency: Expected ErrCorruptWal, got %v", err)
+	}
+	DB := openTestDB(t, dir, nil)
+	report := DB.RecoveryReport()
+	if report.Dropped != 1 || report.Corrupted[0].File != wals[2] {
+		t.Errorf("Expected one dropped record of %s, got %+v", wals[2], report)
+	}
+	for i := range 4 {
+		checkRead(t, DB, testKey(i), testValue(i))
+	}
+	checkRead(t, DB, testKey(4), nil)
+
+	// the cut tail is not seen as corruption once newer logs exist
+	if err := DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	DB = openTestDB(t, dir, &Options{WalRecovery: AbsoluteConsistency})
+	defer DB.Close()
+	checkRead(t, DB, testKey(0), testValue(0))
+}
+
+func TestRecoveryOlderSegment(t *testing.T) {
+	dir, wals := segmentedDB(t)
+
+	// last record of an older segment. newer segments
+	// were written after it so it is no torn tail
+	corruptPage(t, wals[0], 1)
+	if _, err := OpenDB(dir, nil); !errors.Is(err, ErrCorruptWal) {
+		t.Fatalf("TolerateCorruptedTail: Expected ErrCorruptWal, got %v", err)
+	}
+	if _, err := OpenDB(dir, &Options{WalRecovery: AbsoluteConsistency}); !errors.Is(err, ErrCorruptWal) {
+		t.Fatalf("AbsoluteConsistency: Expected ErrCorruptWal, got %v", err)
+	}
+	DB := openTestDB(t, dir, &Options{WalRecovery: SkipCorruptedRecords})
+	defer DB.Close()
+	if report := DB.RecoveryReport(); report.Dropped != 1 {
+		t.Errorf("Expected one dropped record, got %+v", report)
+	}
+	for _, i := range []int{0, 2, 3, 4} {
+		checkRead(t, DB, testKey(i), testValue(i))
+	}
+	checkRead(t, DB, testKey(1), nil)
+}
+
+func TestWalSegments(t *testing.T) {
+	if def := DefaultOptions(); def.WalSegmentSize < def.MemTableSize {
+		t.Errorf("default segments of %d bytes roll inside every memtable", def.WalSegmentSize)
+	}
+
+	dir := t.TempDir()
+	opts := &Options{WalSegmentSize: 2 * testPageSize}
+	DB := openTestDB(t, dir, opts)
+
+	// overwrites spread over many segments
+	for round := range 5 {
+		for i := range 10 {
+			if err := DB.Put(testKey(i), testValue(round*10+i), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if n := len(walFiles(t, dir)); n < 20 {
+		t.Fatalf("Expected a segment per two records, got %d", n)
+	}
+	if err := DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// replayed oldest first so the newest round wins
+	DB = openTestDB(t, dir, opts)
+	for i := range 10 {
+		checkRead(t, DB, testKey(i), testValue(40+i))
+	}
+	if err := DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// segments of flushed memtables are removed
+	opts.MemTableSize = smallOptions().MemTableSize
+	DB = openTestDB(t, dir, opts)
+	for i := range 100 {
+		DB.Put(testKey(i), testValue(i), nil)
+	}
+	waitFlushed(t, DB)
+	DB.mu.RLock()
+	live := make(map[string]bool)
+	for _, seg := range DB.wal[0] {
+		live[seg.name] = true
+	}
+	DB.mu.RUnlock()
+
+	// Close waits for the flusher to finish removing them
+	if err := DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, wal := range walFiles(t, dir) {
+		if !live[wal] {
+			t.Errorf("Expected %s to be removed after flush", wal)
+		}
+	}
+}
+
+func currentManifest(t *testing.T, dir string) string {
+	t.Helper()
+	current, err := os.ReadFile(filepath.Join(dir, CurrentFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, strings.TrimSpace(string(current)))
+}
+
+func flushedDB(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	DB := openTestDB(t, dir, smallOptions())
+	for i := range 200 {
+		DB.Put(testKey(i), testValue(i), nil)
+	}
+	waitFlushed(t, DB)
+	if err := DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestManifestTornTail(t *testing.T) {
+	dir := flushedDB(t)
+
+	// crash while the last edit was logged
+	f, err := os.OpenFile(currentManifest(t, dir), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, 4096))
+	f.Close()
+
+	DB := openTestDB(t, dir, smallOptions())
+	for i := range 200 {
+		checkRead(t, DB, testKey(i), testValue(i))
+	}
+	DB.Close()
+
+	// the torn edit is gone from the rewritten manifest
+	DB = openTestDB(t, dir, smallOptions())
+	defer DB.Close()
+	checkRead(t, DB, testKey(0), testValue(0))
+}
+
+func TestManifestCorruption(t *testing.T) {
+	dir := flushedDB(t)
+
+	// first edit is bad but later ones are fine
+	name := currentManifest(t, dir)
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	f.ReadAt(b, 8)
+	b[0] ^= 0xFF
+	f.WriteAt(b, 8)
+	f.Close()
+
+	if _, err := OpenDB(dir, smallOptions()); !errors.Is(err, page.ErrCorruptPage) {
+		t.Errorf("Expected ErrCorruptPage, got %v", err)
+	}
+}
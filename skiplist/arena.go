@@ -43,9 +43,6 @@ func (arena *Arena) allocNode(h uint32, k []byte, v db.Value) (uint32, uint32, u
 	// size of Node
 	// -1 as our h starts from 0
 	sz := MaxSize - ((MaxHeight - h - 1) * nodeLevelSize)
-	if sz > arena.getSize() {
-		return 0, 0, 0, ErrSizeFull
-	}
 
 	ks := uint32(len(k))
 	vs := v.GetSize()
@@ -55,7 +52,20 @@ func (arena *Arena) allocNode(h uint32, k []byte, v db.Value) (uint32, uint32, u
 
 	// size of all our data
 	deltaLoc := sz + ks + vs + align
-	newLoc := arena.loc.Add(deltaLoc)
+
+	// reserve the space only if it fits
+	// so loc never passes the end of buf
+	var newLoc uint32
+	for {
+		loc := arena.loc.Load()
+		if uint64(loc)+uint64(deltaLoc) > uint64(arena.size.Load()) {
+			return 0, 0, 0, ErrSizeFull
+		}
+		if arena.loc.CompareAndSwap(loc, loc+deltaLoc) {
+			newLoc = loc + deltaLoc
+			break
+		}
+	}
 
 	// start locations
 	startLoc := (newLoc - (sz + ks + vs)) & ^align
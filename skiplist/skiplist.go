@@ -8,7 +8,6 @@ import (
 	"errors"
 	"math"
 	"sync/atomic"
-	"time"
 	_ "unsafe"
 
 	"github.com/alimx07/IrisDB/db"
@@ -66,10 +65,11 @@ func newNode(arena *Arena, level uint32, k []byte, v db.Value) (*Node, error) {
 }
 
 type SkipList struct {
-	arena  *Arena       // Arena to store our Nodes
-	head   *Node        // head of the skiplist
-	height atomic.Int32 // curr Height of skiplist
-	ref    atomic.Int32 // Number of Items operate on Skiplist now
+	arena    *Arena        // Arena to store our Nodes
+	head     *Node         // head of the skiplist
+	height   atomic.Int32  // curr Height of skiplist
+	ref      atomic.Int32  // Number of Items operate on Skiplist now
+	reserved atomic.Uint32 // arena bytes promised to writers
 }
 
 func NewSkipList(sz uint32) *SkipList {
@@ -79,19 +79,36 @@ func NewSkipList(sz uint32) *SkipList {
 		head:  node,
 		arena: arena,
 	}
+	sl.reserved.Store(arena.loc.Load())
 	return sl
 }
 
 // return the value of K
 func (sl *SkipList) Get(k []byte) db.Value {
 
-	node, found := sl.seek(k, math.MaxUint64)
+	node, found := sl.seek(k, math.MaxUint64, true)
 	if found {
 		return db.NewValue(node.getVal(sl.arena))
 	}
 	return db.Value{}
 }
 
+// Find return the newest value of K with ts <= ts
+// and whether K exists at all
+func (sl *SkipList) Find(k []byte, ts uint64) (db.Value, bool) {
+	val, _, found := sl.FindVersion(k, ts)
+	return val, found
+}
+
+// FindVersion is Find that also returns ts of the found version
+func (sl *SkipList) FindVersion(k []byte, ts uint64) (db.Value, uint64, bool) {
+	node, found := sl.seek(k, ts, true)
+	if found {
+		return db.NewValue(node.getVal(sl.arena)), db.GetTsAsUint64(node.getKey(sl.arena)), true
+	}
+	return db.Value{}, 0, false
+}
+
 func (sl *SkipList) insert(k []byte, v db.Value, topLevel int, prev, succ *[MaxHeight]*Node) error {
 
 	node, err := newNode(sl.arena, uint32(topLevel), k, v)
@@ -122,7 +139,8 @@ func (sl *SkipList) insert(k []byte, v db.Value, topLevel int, prev, succ *[MaxH
 }
 
 // Insert New Key-Value Pair in the skiplist
-func (sl *SkipList) Insert(k []byte, v db.Value) {
+// return ErrSizeFull if the arena has no room for it
+func (sl *SkipList) Insert(k []byte, v db.Value) error {
 	toplevel := sl.randomLevel()
 
 	h := int(sl.checkHeight(int32(toplevel)))
@@ -131,7 +149,7 @@ func (sl *SkipList) Insert(k []byte, v db.Value) {
 
 	sl.findAllBounds(k, h, &prev, &succ)
 
-	sl.insert(k, v, toplevel, &prev, &succ)
+	return sl.insert(k, v, toplevel, &prev, &succ)
 }
 
 // Insert Key-Value pair in the skiplist using hint (near previous node)
@@ -198,7 +216,9 @@ func (sl *SkipList) InsertWithHints(k []byte, v db.Value, hint *Hint) error {
 
 	}
 
-	sl.insert(k, v, toplevel, &hint.prev, &hint.succ)
+	if err := sl.insert(k, v, toplevel, &hint.prev, &hint.succ); err != nil {
+		return err
+	}
 
 	hint.Level = int32(currlevel)
 	return nil
@@ -243,8 +263,9 @@ func (sl *SkipList) findAllBounds(k []byte, h int, prev, succ *[MaxHeight]*Node)
 	}
 }
 
-// Find a node with key >= k
-func (sl *SkipList) seek(k []byte, ts uint64) (*Node, bool) {
+// Find a node with key >= k and ts <= ts
+// exact lookups stop at the versions of k
+func (sl *SkipList) seek(k []byte, ts uint64, exact bool) (*Node, bool) {
 	level := sl.height.Load()
 	curr := sl.head
 	for {
@@ -263,24 +284,20 @@ func (sl *SkipList) seek(k []byte, ts uint64) (*Node, bool) {
 				level--
 				continue
 			}
-			if cmp == 0 && ts >= db.GetTsAsUint64(nxKey) {
-				return nxNode, true
-			}
-
-			// IF we reach level 0 and did not find the node
-			// in this case we already on node.key > key
+			// IF we reach level 0 we are on the first node.key >= key
 			// Loop until we found node.ts <= ts
-			for {
-				nxNode = nxNode.nextNode(0, sl.arena)
-				if nxNode == nil {
+			for nxNode != nil {
+				nxKey = nxNode.getKey(sl.arena)
+				found := db.CompareRawKeys(nxKey, k) == 0
+				if exact && !found {
 					return nil, false
 				}
-				nxKey = nxNode.getKey(sl.arena)
 				if ts >= db.GetTsAsUint64(nxKey) {
-					return nxNode, false
+					return nxNode, found
 				}
-
+				nxNode = nxNode.nextNode(0, sl.arena)
 			}
+			return nil, false
 		}
 		curr = nxNode
 	}
@@ -305,6 +322,35 @@ func (sl *SkipList) checkHeight(level int32) int32 {
 	return currHeight
 }
 
+// Reserve n bytes of the arena for inserts of one writer
+// false if they don't fit. inserts of writers that reserved
+// no more than they use never fail with ErrSizeFull
+func (sl *SkipList) Reserve(n uint32) bool {
+	for {
+		r := sl.reserved.Load()
+		if uint64(r)+uint64(n) > uint64(sl.arena.size.Load()) {
+			return false
+		}
+		if sl.reserved.CompareAndSwap(r, r+n) {
+			return true
+		}
+	}
+}
+
+// Free returns the arena bytes not reserved yet
+func (sl *SkipList) Free() uint32 {
+	return sl.arena.size.Load() - sl.reserved.Load()
+}
+
+// Room returns the bytes a new skiplist of size sz can reserve.
+// the head node takes full height plus alignment padding
+func Room(sz uint32) uint32 {
+	if sz < MaxSize+align {
+		return 0
+	}
+	return sz - (MaxSize + align)
+}
+
 func (sl *SkipList) GetSize() uint32 {
 	return sl.arena.getSize()
 }
@@ -372,9 +418,14 @@ type Iterator struct {
 
 // The Iterator take a snapshot on Memtable at ts
 func Newiterator(sl *SkipList) *Iterator {
+	return NewiteratorAt(sl, db.Now())
+}
+
+// The Iterator only see keys with ts <= ts
+func NewiteratorAt(sl *SkipList, ts uint64) *Iterator {
 	sl.ref.Add(1)
 	return &Iterator{
-		ts: uint64(time.Now().UnixNano()),
+		ts: ts,
 		sl: sl,
 	}
 }
@@ -383,7 +434,7 @@ func Newiterator(sl *SkipList) *Iterator {
 
 // Seek node.key >= k at the time a request happens
 func (it *Iterator) Seek(k []byte) {
-	it.cursor, _ = it.sl.seek(k, it.ts)
+	it.cursor, _ = it.sl.seek(k, it.ts, false)
 }
 
 // Get Value of current Key
@@ -8,6 +8,7 @@ package skiplist
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"math/rand"
 	"sync/atomic"
 	"testing"
@@ -198,6 +199,70 @@ func TestIteratorSnapshot(t *testing.T) {
 
 }
 
+func TestIteratorSeekMissingKey(t *testing.T) {
+	sl := NewSkipList(1 << 20)
+	for i := 0; i < 10; i += 2 {
+		sl.Insert(db.NewKey([]byte(fmt.Sprintf("key-%d", i))), db.NewValue([]byte(fmt.Sprintf("val-%d", i))))
+	}
+
+	it := Newiterator(sl)
+	defer it.Close()
+
+	// key-3 does not exist. so seek must stop on key-4
+	it.Seek(db.NewKey([]byte("key-3")))
+	if !it.Valid() {
+		t.Fatal("Iterator should be valid after seeking a key smaller than existing keys")
+	}
+	if !bytes.Equal(it.Get(), []byte("val-4")) {
+		t.Errorf("Expected val-4, got %s", it.Get())
+	}
+
+	if _, found := sl.Find(db.NewKey([]byte("key-3")), math.MaxUint64); found {
+		t.Error("Find should not report a missing key as found")
+	}
+}
+
+func TestFindAtTs(t *testing.T) {
+	sl := NewSkipList(1 << 20)
+	sl.Insert(db.NewKeyAt([]byte("key"), 10), db.NewValue([]byte("old")))
+	sl.Insert(db.NewKeyAt([]byte("key"), 20), db.NewValue([]byte("new")))
+
+	v, found := sl.Find(db.NewKey([]byte("key")), 15)
+	if !found || !bytes.Equal(v.GetValue(), []byte("old")) {
+		t.Errorf("Expected old value at its ts, got %s", v.GetValue())
+	}
+	if _, found := sl.Find(db.NewKey([]byte("key")), 9); found {
+		t.Error("Key should not be visible before its first version")
+	}
+	if _, ts, _ := sl.FindVersion(db.NewKey([]byte("key")), math.MaxUint64); ts != 20 {
+		t.Errorf("Expected newest version ts 20, got %d", ts)
+	}
+}
+
+func TestFindStopsAtKey(t *testing.T) {
+	sl := NewSkipList(1 << 20)
+	sl.Insert(db.NewKeyAt([]byte("key"), 20), db.NewValue([]byte("new")))
+	for i := range 100 {
+		sl.Insert(db.NewKeyAt([]byte(fmt.Sprintf("key-%d", i)), 5), db.NewValue([]byte("other")))
+	}
+
+	// no version of key at ts 10. later keys are not its versions
+	if node, found := sl.seek(db.NewKey([]byte("key")), 10, true); node != nil || found {
+		t.Error("Exact seek should stop at the versions of the key")
+	}
+	if _, found := sl.Find(db.NewKey([]byte("key")), 10); found {
+		t.Error("Key should not be visible before its first version")
+	}
+
+	// iterators still move on to the next visible key
+	it := NewiteratorAt(sl, 10)
+	defer it.Close()
+	it.Seek(db.NewKey([]byte("key")))
+	if !it.Valid() || !bytes.Equal(db.RawKey(it.GetKey()), []byte("key-0")) {
+		t.Error("Iterator seek should land on key-0")
+	}
+}
+
 func TestMergeIterator_MergesInOrder(t *testing.T) {
 	sl1 := NewSkipList(1 << 20)
 	sl2 := NewSkipList(1 << 20)
@@ -0,0 +1,85 @@
+package irisdb
+
+import (
+	"container/list"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/alimx07/IrisDB/db"
+)
+
+// Snapshot is a consistent view of the whole DB at its creation time
+// while it is alive compaction keeps the versions it can see
+// Release must be called once it is not needed
+type Snapshot struct {
+	db       *IrisDB
+	ts       uint64
+	elem     *list.Element
+	released atomic.Bool
+}
+
+func (DB *IrisDB) GetSnapshot() *Snapshot {
+	// no write is half applied while the ts is taken
+	// so everything written before it is visible to the snapshot
+	DB.commitMu.Lock()
+	defer DB.commitMu.Unlock()
+
+	// ts is taken under the lock. so a compaction that missed
+	// this snapshot only holds versions older than it
+	DB.snapMu.Lock()
+	s := &Snapshot{db: DB, ts: db.Now()}
+	s.elem = DB.snapshots.PushBack(s.ts)
+	DB.snapMu.Unlock()
+	return s
+}
+
+// Time of the snapshot
+func (s *Snapshot) Time() time.Time {
+	return time.Unix(0, int64(s.ts))
+}
+
+// Read key as it was at the snapshot time
+func (s *Snapshot) Read(key []byte, opts *ReadOptions) ([]byte, error) {
+	if opts == nil {
+		opts = DefaultReadOptions()
+	}
+	return s.db.get(key, s.ts, !opts.SkipChecksums)
+}
+
+// NewIterator over [lower, upper) as it was at the snapshot time
+func (s *Snapshot) NewIterator(lower, upper []byte, opts *ReadOptions) *Iterator {
+	return s.db.newIterator(lower, upper, s.ts, opts)
+}
+
+// Release let compaction drop the versions kept for this snapshot
+func (s *Snapshot) Release() {
+	if !s.released.CompareAndSwap(false, true) {
+		return
+	}
+	s.db.snapMu.Lock()
+	s.db.snapshots.Remove(s.elem)
+	s.db.snapMu.Unlock()
+}
+
+// ts of live snapshots (oldest first)
+func (DB *IrisDB) snapshotTimes() []uint64 {
+	DB.snapMu.Lock()
+	defer DB.snapMu.Unlock()
+	times := make([]uint64, 0, DB.snapshots.Len())
+	for e := DB.snapshots.Front(); e != nil; e = e.Next() {
+		times = append(times, e.Value.(uint64))
+	}
+
+	// wall clock may go backward
+	slices.Sort(times)
+	return times
+}
+
+// stripe of ts is the index of the oldest snapshot that can see it
+// (len(snapshots) if no snapshot can)
+// only the newest version of a key inside every stripe is visible to anyone
+func stripe(snapshots []uint64, ts uint64) int {
+	i, _ := slices.BinarySearch(snapshots, ts)
+	return i
+}
@@ -0,0 +1,107 @@
+package irisdb
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSnapshotAfterCompaction(t *testing.T) {
+	DB := openTestDB(t, t.TempDir(), compactOptions())
+	defer DB.Close()
+
+	key := []byte("key")
+	DB.Put(key, []byte("old"), nil)
+	snap := DB.GetSnapshot()
+	DB.Put(key, []byte("new"), nil)
+	for i := range 300 {
+		if err := DB.Put(testKey(i), testValue(i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitCompacted(t, DB)
+	DB.mu.RLock()
+	l0 := len(DB.sstables[0])
+	DB.mu.RUnlock()
+	if tableCount(DB) == l0 {
+		t.Fatal("Expected compacted tables")
+	}
+
+	// versions seen by the snapshot were kept
+	if val, err := snap.Read(key, nil); err != nil || string(val) != "old" {
+		t.Errorf("Expected old, got %q, %v", val, err)
+	}
+	if val, err := snap.Read(testKey(1), nil); err != nil || val != nil {
+		t.Errorf("Expected key written after the snapshot to be missing, got %q, %v", val, err)
+	}
+	checkRead(t, DB, key, []byte("new"))
+	snap.Release()
+}
+
+// writes in flight when a snapshot (or iterator) is taken are
+// either fully visible to it or not at all
+func TestSnapshotRepeatable(t *testing.T) {
+	DB := openTestDB(t, t.TempDir(), nil)
+	defer DB.Close()
+
+	// threads are interleaved even on a single cpu
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	a, b := []byte("a"), []byte("b")
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var writes atomic.Int64
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				val := []byte(fmt.Sprintf("%d-%d", w, i))
+				batch := NewWriteBatch()
+				batch.Put(a, val)
+				batch.Put(b, val)
+				if err := DB.Write(batch, nil); err != nil {
+					t.Error(err)
+					return
+				}
+				writes.Add(1)
+			}
+		}()
+	}
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	for writes.Load() < 20000 {
+		snap := DB.GetSnapshot()
+		// let writers in flight apply between the reads
+		first, _ := snap.Read(a, nil)
+		runtime.Gosched()
+		other, _ := snap.Read(b, nil)
+		runtime.Gosched()
+		again, _ := snap.Read(a, nil)
+		snap.Release()
+		if string(first) != string(again) || string(first) != string(other) {
+			t.Fatalf("Snapshot reads changed: a=%q b=%q a=%q", first, other, again)
+		}
+
+		it := DB.NewIterator(nil, nil, nil)
+		var vals []string
+		for ; it.Valid(); it.Next() {
+			vals = append(vals, string(it.Value()))
+			runtime.Gosched()
+		}
+		it.Close()
+		if len(vals) == 2 && vals[0] != vals[1] {
+			t.Fatalf("Iterator saw half a batch: %q", vals)
+		}
+	}
+}
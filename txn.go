@@ -0,0 +1,180 @@
+package irisdb
+
+import (
+	"errors"
+	"math"
+)
+
+var (
+	ErrConflict = errors.New("transaction conflict")
+	ErrTxnDone  = errors.New("transaction already committed or rolled back")
+)
+
+// Txn is a transaction that reads from a snapshot taken
+// at its start and buffers its writes.
+//
+// optimistic (BeginTxn): Commit fails with ErrConflict if any key it read
+// was written after its start (by txns or plain writes)
+//
+// pessimistic (BeginPessimisticTxn): every written key and every key read
+// with GetForUpdate is locked until Commit/Rollback. a lock that can't be taken
+// fails the call with ErrLockTimeout or ErrDeadlock and the txn should roll back.
+// plain writes outside txns don't take locks
+type Txn struct {
+	db          *IrisDB
+	id          uint64
+	pessimistic bool
+	snap        *Snapshot
+	batch       *WriteBatch
+	writes      map[string][]byte // pending writes (nil value is a delete)
+	reads       map[string]struct{}
+	locked      map[string]struct{}
+	done        bool
+}
+
+func (DB *IrisDB) BeginTxn() (*Txn, error) {
+	return DB.beginTxn(false)
+}
+
+func (DB *IrisDB) BeginPessimisticTxn() (*Txn, error) {
+	return DB.beginTxn(true)
+}
+
+func (DB *IrisDB) beginTxn(pessimistic bool) (*Txn, error) {
+	if DB.isClosed.Load() {
+		return nil, ErrDBClosed
+	}
+
+	// everything written before the start ts is visible to the txn
+	snap := DB.GetSnapshot()
+	return &Txn{
+		db:          DB,
+		id:          DB.txnID.Add(1),
+		pessimistic: pessimistic,
+		snap:        snap,
+		batch:       NewWriteBatch(),
+		writes:      make(map[string][]byte),
+		reads:       make(map[string]struct{}),
+		locked:      make(map[string]struct{}),
+	}, nil
+}
+
+// Get reads key as seen by the txn (own writes first)
+func (txn *Txn) Get(key []byte, opts *ReadOptions) ([]byte, error) {
+	if txn.done {
+		return nil, ErrTxnDone
+	}
+	if val, ok := txn.writes[string(key)]; ok {
+		return val, nil
+	}
+	val, err := txn.snap.Read(key, opts)
+	if err != nil {
+		return nil, err
+	}
+	if !txn.pessimistic {
+		txn.reads[string(key)] = struct{}{}
+	}
+	return val, nil
+}
+
+// GetForUpdate locks key then reads its latest value
+// (same as Get in optimistic txns)
+func (txn *Txn) GetForUpdate(key []byte, opts *ReadOptions) ([]byte, error) {
+	if !txn.pessimistic {
+		return txn.Get(key, opts)
+	}
+	if txn.done {
+		return nil, ErrTxnDone
+	}
+	if err := txn.lock(key); err != nil {
+		return nil, err
+	}
+	if val, ok := txn.writes[string(key)]; ok {
+		return val, nil
+	}
+
+	// no one else can commit key while we hold it
+	return txn.db.Read(key, opts)
+}
+
+func (txn *Txn) Put(key, value []byte) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	if err := txn.lock(key); err != nil {
+		return err
+	}
+	txn.batch.Put(key, value)
+	txn.writes[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (txn *Txn) Delete(key []byte) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	if err := txn.lock(key); err != nil {
+		return err
+	}
+	txn.batch.Delete(key)
+	txn.writes[string(key)] = nil
+	return nil
+}
+
+func (txn *Txn) lock(key []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if !txn.pessimistic {
+		return nil
+	}
+	k := string(key)
+	if _, ok := txn.locked[k]; ok {
+		return nil
+	}
+	if err := txn.db.locks.lock(txn.id, k, txn.db.opts.LockTimeout); err != nil {
+		return err
+	}
+	txn.locked[k] = struct{}{}
+	return nil
+}
+
+// Commit applies the txn writes as one batch
+// the txn is finished whatever the result
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	defer txn.finish()
+
+	DB := txn.db
+	DB.commitMu.Lock()
+	defer DB.commitMu.Unlock()
+
+	for key := range txn.reads {
+		_, version, err := DB.getVersion([]byte(key), math.MaxUint64, true)
+		if err != nil {
+			return err
+		}
+		if version > txn.snap.ts {
+			return ErrConflict
+		}
+	}
+	return DB.write(txn.batch, nil)
+}
+
+// Rollback drops the txn writes
+func (txn *Txn) Rollback() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.finish()
+	return nil
+}
+
+func (txn *Txn) finish() {
+	txn.done = true
+	txn.snap.Release()
+	txn.db.locks.unlock(txn.id, txn.locked)
+	txn.batch.Clear()
+}
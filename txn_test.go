@@ -0,0 +1,138 @@
+package irisdb
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestTxnReadYourWrites(t *testing.T) {
+	DB := openTestDB(t, t.TempDir(), nil)
+	defer DB.Close()
+	DB.Put(testKey(2), testValue(2), nil)
+
+	txn, err := DB.BeginTxn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.Put(testKey(1), testValue(1))
+	txn.Delete(testKey(2))
+	if val, err := txn.Get(testKey(1), nil); err != nil || string(val) != string(testValue(1)) {
+		t.Errorf("Expected own write, got %q, %v", val, err)
+	}
+	if val, err := txn.Get(testKey(2), nil); err != nil || val != nil {
+		t.Errorf("Expected own delete, got %q, %v", val, err)
+	}
+
+	// pending writes are private
+	checkRead(t, DB, testKey(1), nil)
+	checkRead(t, DB, testKey(2), testValue(2))
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	checkRead(t, DB, testKey(1), testValue(1))
+	checkRead(t, DB, testKey(2), nil)
+	if err := txn.Commit(); err != ErrTxnDone {
+		t.Errorf("Expected ErrTxnDone, got %v", err)
+	}
+}
+
+func TestTxnConflict(t *testing.T) {
+	DB := openTestDB(t, t.TempDir(), nil)
+	defer DB.Close()
+	DB.Put(testKey(1), testValue(1), nil)
+
+	// plain write after the txn read
+	txn, _ := DB.BeginTxn()
+	txn.Get(testKey(1), nil)
+	DB.Put(testKey(1), testValue(2), nil)
+	txn.Put(testKey(3), testValue(3))
+	if err := txn.Commit(); err != ErrConflict {
+		t.Fatalf("Expected ErrConflict, got %v", err)
+	}
+	checkRead(t, DB, testKey(3), nil)
+
+	// first committer wins
+	t1, _ := DB.BeginTxn()
+	t2, _ := DB.BeginTxn()
+	t1.Get(testKey(1), nil)
+	t2.Get(testKey(1), nil)
+	t1.Put(testKey(1), testValue(10))
+	t2.Put(testKey(1), testValue(20))
+	if err := t1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := t2.Commit(); err != ErrConflict {
+		t.Fatalf("Expected ErrConflict, got %v", err)
+	}
+	checkRead(t, DB, testKey(1), testValue(10))
+
+	// blind writes don't conflict
+	t3, _ := DB.BeginTxn()
+	DB.Put(testKey(1), testValue(4), nil)
+	t3.Put(testKey(1), testValue(5))
+	if err := t3.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	checkRead(t, DB, testKey(1), testValue(5))
+}
+
+func TestTxnRollback(t *testing.T) {
+	DB := openTestDB(t, t.TempDir(), nil)
+	defer DB.Close()
+
+	txn, _ := DB.BeginTxn()
+	txn.Put(testKey(1), testValue(1))
+	if err := txn.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	checkRead(t, DB, testKey(1), nil)
+	if err := txn.Put(testKey(1), testValue(1)); err != ErrTxnDone {
+		t.Errorf("Expected ErrTxnDone, got %v", err)
+	}
+	if _, err := txn.Get(testKey(1), nil); err != ErrTxnDone {
+		t.Errorf("Expected ErrTxnDone, got %v", err)
+	}
+	if err := txn.Rollback(); err != ErrTxnDone {
+		t.Errorf("Expected ErrTxnDone, got %v", err)
+	}
+}
+
+// increments retried on conflict are never lost
+func TestTxnCounter(t *testing.T) {
+	DB := openTestDB(t, t.TempDir(), nil)
+	defer DB.Close()
+	key := []byte("counter")
+
+	const workers, incs = 8, 50
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range incs {
+				for {
+					txn, _ := DB.BeginTxn()
+					val, err := txn.Get(key, nil)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					n, _ := strconv.Atoi(string(val))
+					txn.Put(key, []byte(strconv.Itoa(n+1)))
+					err = txn.Commit()
+					if err == nil {
+						break
+					}
+					if !errors.Is(err, ErrConflict) {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	checkRead(t, DB, key, []byte(strconv.Itoa(workers*incs)))
+}
@@ -0,0 +1,169 @@
+package irisdb
+
+import (
+	"errors"
+
+	"github.com/alimx07/IrisDB/db"
+)
+
+var ErrUpdatesPurged = errors.New("requested updates were already removed from the WAL")
+
+// Update is a single committed mutation read from the WAL
+type Update struct {
+	Op    byte // OpPut or OpDelete
+	Key   []byte
+	Value []byte // nil for OpDelete
+	Ts    uint64 // commit ts (shared by all updates of a batch)
+}
+
+// UpdatesIterator walks committed mutations in WAL (commit) order
+// moving across log segments. once it catches up Next returns false.
+// calling Next again later resumes with the records appended since.
+// records get their ts in log order. so to resume in another
+// iterator pass Ts+1 of the last batch seen.
+//
+// writes done with DisableWAL are never seen
+type UpdatesIterator struct {
+	db      *IrisDB
+	since   uint64
+	last    uint64 // ts of the last returned update
+	seg     *WAL
+	segNum  uint64
+	pgNum   uint32
+	pending []Update
+	curr    Update
+	err     error
+}
+
+// GetUpdatesSince returns an iterator over updates with ts >= since
+// it fails with ErrUpdatesPurged if some of them were flushed
+// and their log removed
+func (DB *IrisDB) GetUpdatesSince(since uint64) (*UpdatesIterator, error) {
+	if DB.isClosed.Load() {
+		return nil, ErrDBClosed
+	}
+	if purged := DB.walPurged.Load(); purged > 0 && since <= purged {
+		return nil, ErrUpdatesPurged
+	}
+	return &UpdatesIterator{db: DB, since: since}, nil
+}
+
+func (it *UpdatesIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	for {
+		if len(it.pending) > 0 {
+			it.curr = it.pending[0]
+			it.pending = it.pending[1:]
+			if it.curr.Ts < it.since {
+				continue
+			}
+			it.last = max(it.last, it.curr.Ts)
+			return true
+		}
+
+		if it.seg == nil || it.pgNum >= it.seg.written.Load() {
+			// rest of the segment is not written yet
+			next := it.db.nextSegment(it.segNum)
+			if next == nil {
+				return false
+			}
+			if it.seg != nil && it.pgNum < it.seg.written.Load() {
+				continue
+			}
+
+			// segments between the current and next one were removed
+			// with updates we have not returned
+			if purged := it.db.walPurged.Load(); purged > 0 && purged >= it.since && purged > it.last {
+				it.err = ErrUpdatesPurged
+				return false
+			}
+			it.seg, it.pgNum = next, 0
+			it.segNum, _ = parseFileNum(next.name)
+			continue
+		}
+
+		data, last, err := it.seg.page.Read(it.pgNum)
+		if err != nil {
+			it.err = err
+			if it.seg.page.IsClosed.Load() {
+				it.err = ErrUpdatesPurged
+			}
+			return false
+		}
+		entry, err := it.seg.deserializeEntry(data)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.pgNum = last + 1
+		if it.err = it.decode(entry); it.err != nil {
+			return false
+		}
+	}
+}
+
+// expand the record into pending updates
+func (it *UpdatesIterator) decode(entry *LogEntry) error {
+	if entry.Op != OpBatch {
+		u := Update{Op: entry.Op, Key: db.RawKey(entry.Key), Value: entry.Value, Ts: entry.ts()}
+		if u.Op == OpDelete {
+			u.Value = nil
+		}
+		it.pending = append(it.pending, u)
+		return nil
+	}
+	b, ts, err := batchFromEntry(entry)
+	if err != nil {
+		return err
+	}
+	return b.forEach(func(op byte, key, value []byte) error {
+		u := Update{Op: op, Key: key, Ts: ts}
+		if op == OpPut {
+			u.Value = value
+		}
+		it.pending = append(it.pending, u)
+		return nil
+	})
+}
+
+// Update returns the current update
+func (it *UpdatesIterator) Update() Update {
+	return it.curr
+}
+
+func (it *UpdatesIterator) Err() error {
+	return it.err
+}
+
+// oldest live segment newer than num
+func (DB *IrisDB) nextSegment(num uint64) *WAL {
+	DB.mu.RLock()
+	defer DB.mu.RUnlock()
+
+	var next *WAL
+	nextNum := uint64(0)
+	for _, segs := range DB.wal {
+		for _, seg := range segs {
+			n, _ := parseFileNum(seg.name)
+			if n > num && (next == nil || n < nextNum) {
+				next, nextNum = seg, n
+			}
+		}
+	}
+	return next
+}
+
+// mark updates up to the newest one in segs as gone
+func (DB *IrisDB) purgeUpdates(segs []*WAL) {
+	for _, seg := range segs {
+		ts := seg.maxTs.Load()
+		for {
+			curr := DB.walPurged.Load()
+			if ts <= curr || DB.walPurged.CompareAndSwap(curr, ts) {
+				break
+			}
+		}
+	}
+}
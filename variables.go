@@ -2,28 +2,15 @@ package irisdb
 
 import (
 	"os"
-	"time"
 )
 
-var (
-	Fsync            = true
-	SyncInterval     = 100 * time.Millisecond
-	PageSize         = 4096
-	Compression      = true
-	Wal              = true
-	Flag             = os.O_CREATE | os.O_RDWR
-	Permission       = 0644
-	FalsePostiveProb = 0.01
-	DBName           = "irisdb"
-	MemTableSize     = 64 * 1024
-	AvgKeySize       = 16
-	SstableSize      = 128 * 1024 // size of sstable in level 0
-	SizeMultiple     = 5          // SizeLevel(i) = Multiple * SizeLevel(i-1)
-	TOMPOSTONE       = []byte{0xFD, 0xFE, 0xFA, 0xF9}
-	MaxLevels        = 6
-)
+// configuration of a DB lives in Options
+
+var TOMPOSTONE = []byte{0xFD, 0xFE, 0xFA, 0xF9}
 
 const (
+	Flag             = os.O_CREATE | os.O_RDWR
+	DBName           = "irisdb" // prefix of table and log files
 	KeyExtension     = ".key"
 	ValExtension     = ".val"
 	BloomExtension   = ".bf"
@@ -31,4 +18,7 @@ const (
 	SSTABLEExtesnion = ".sst"
 	DBExtension      = ".irisdb"
 	MagicNumber      = 0xAB75DE95
+	FormatVersion    = 3                       // v2: 32-bit value pointers, v3: page checksums
+	ValPtrSize       = 4                       // value pgNum stored before every key in blocks
+	MaxKeySize       = 0xFFFF - 8 - ValPtrSize // room for ts and value pgNum inside 2 bytes keyLen
 )
@@ -2,22 +2,51 @@ package irisdb
 
 import (
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/alimx07/IrisDB/db"
 	"github.com/alimx07/IrisDB/page"
 )
 
 type WAL struct {
-	page *page.Page
+	name     string
+	page     *page.Page
+	pageSize uint16
+	written  atomic.Uint32 // pages fully written (safe for tailing readers)
+	maxTs    atomic.Uint64 // newest record ts
+
+	// group commit
+	mu      sync.Mutex
+	queue   []*walRequest // records waiting for the next group
+	leading bool          // a leader is writing a group
+	groups  atomic.Uint64 // groups written
+	syncs   atomic.Uint64 // fsyncs of written groups
+}
+
+// record of a single writer in the commit queue
+type walRequest struct {
+	data  []byte
+	ts    uint64
+	stamp bool // ts is taken by the leader (batch records)
+	sync  bool
+	pgNum uint32
+	err   error
+	lead  bool          // woken to lead the next group instead of done
+	wake  chan struct{} // closed when done or chosen to lead
 }
 
 // NewWal creates a new Write-Ahead Log
-func NewWal(name string, pageSize uint16, fsync bool, syncInterval time.Duration) (*WAL, error) {
+func NewWal(name string, perm os.FileMode, pageSize uint16, fsync bool, syncInterval time.Duration) (*WAL, error) {
 	pg, err := page.InitPage(
 		name,
 		os.O_CREATE|os.O_RDWR,
-		0644,
+		perm,
 		pageSize,
 		fsync,
 		syncInterval,
@@ -27,11 +56,25 @@ func NewWal(name string, pageSize uint16, fsync bool, syncInterval time.Duration
 	}
 
 	w := &WAL{
-		page: pg,
+		name:     name,
+		page:     pg,
+		pageSize: pageSize,
 	}
+	w.written.Store(pg.GetLastPage())
 	return w, nil
 }
 
+var ErrCorruptWal = errors.New("wal record is corrupted")
+
+const walHeader = 11 // CRC | Op | KeyLen | ValueLen
+
+// Wal Operations
+const (
+	OpPut byte = iota + 1
+	OpDelete
+	OpBatch // Key is the batch timestamp, Value the serialized batch
+)
+
 // Single Wal Entry
 type LogEntry struct {
 	Op    byte // Operation type
@@ -39,89 +82,287 @@ type LogEntry struct {
 	Value []byte
 }
 
+// commit ts of the entry
+func (entry *LogEntry) ts() uint64 {
+	if len(entry.Key) < 8 {
+		return 0
+	}
+	if entry.Op == OpBatch {
+		return binary.BigEndian.Uint64(entry.Key)
+	}
+	return db.GetTsAsUint64(entry.Key)
+}
+
+// Write appends entry to the log. it is durable
+// only after the next periodic sync
 func (w *WAL) Write(entry *LogEntry) (uint32, error) {
+	return w.commit(&walRequest{data: w.serializeEntry(entry), ts: entry.ts()})
+}
+
+// SyncWrite appends entry and returns after it is fsynced
+func (w *WAL) SyncWrite(entry *LogEntry) (uint32, error) {
+	return w.commit(&walRequest{data: w.serializeEntry(entry), ts: entry.ts(), sync: true})
+}
+
+// LogBatch appends b with a ts taken by the group leader
+// so records are ordered by ts in the log. returns the ts
+func (w *WAL) LogBatch(b *WriteBatch, sync bool) (uint64, error) {
+	req := &walRequest{data: w.encodeEntry(batchEntry(b, 0)), stamp: true, sync: sync}
+	_, err := w.commit(req)
+	return req.ts, err
+}
 
-	data := w.serializeEntry(entry)
+func (w *WAL) commit(req *walRequest) (uint32, error) {
 
-	pageNum, err := w.page.Write(data)
-	if err != nil {
-		return 0, err
+	/*
+	   GROUP COMMIT
+	   writers queue their records. the first one finding no
+	   leader becomes the leader: it takes everything queued,
+	   appends it as one run of pages, fsyncs once (if any
+	   writer asked for it) and wakes the group.
+	   writers that queued meanwhile form the next group and
+	   the oldest of them is woken to lead it.
+	*/
+
+	req.wake = make(chan struct{})
+	w.mu.Lock()
+	w.queue = append(w.queue, req)
+	if w.leading {
+		w.mu.Unlock()
+		<-req.wake
+		if !req.lead {
+			return req.pgNum, req.err
+		}
+		w.mu.Lock()
+	}
+	w.leading = true
+	group := w.queue
+	w.queue = nil
+	w.mu.Unlock()
+
+	w.writeGroup(group)
+
+	w.mu.Lock()
+	if len(w.queue) > 0 {
+		next := w.queue[0]
+		next.lead = true
+		close(next.wake)
+	} else {
+		w.leading = false
+	}
+	w.mu.Unlock()
+
+	for _, r := range group {
+		if r != req {
+			close(r.wake)
+		}
+	}
+	return req.pgNum, req.err
+}
+
+func (w *WAL) writeGroup(group []*walRequest) {
+	records := make([][]byte, len(group))
+	sync := false
+	for i, r := range group {
+		// only the leader appends. so ts grow in log order
+		if r.stamp {
+			r.ts = db.Now()
+			binary.BigEndian.PutUint64(r.data[walHeader:], r.ts)
+			sealEntry(r.data)
+		}
+		records[i] = r.data
+		sync = sync || r.sync
+	}
+	pgNums, err := w.page.WriteAll(records)
+	if err == nil && sync {
+		err = w.page.Sync()
+		w.syncs.Add(1)
+	}
+	w.groups.Add(1)
+
+	// only the leader appends so no other group is in flight
+	w.written.Store(w.page.GetLastPage())
+	for i, r := range group {
+		r.err = err
+		if err == nil {
+			r.pgNum = pgNums[i]
+			w.setMaxTs(r.ts)
+		}
 	}
+}
 
-	return pageNum, nil
+func (w *WAL) setMaxTs(ts uint64) {
+	for {
+		curr := w.maxTs.Load()
+		if ts <= curr || w.maxTs.CompareAndSwap(curr, ts) {
+			return
+		}
+	}
 }
 
-func (w *WAL) Read(pageNum uint16) (*LogEntry, error) {
+func (w *WAL) Read(pageNum uint32) (*LogEntry, error) {
 	data, _, err := w.page.Read(pageNum)
 	if err != nil {
 		return nil, err
 	}
 
-	return w.deserializeEntry(data), nil
+	return w.deserializeEntry(data)
 }
 
 func (w *WAL) serializeEntry(entry *LogEntry) []byte {
+	return sealEntry(w.encodeEntry(entry))
+}
+
+// entry without its CRC
+func (w *WAL) encodeEntry(entry *LogEntry) []byte {
 
 	/*
 	   ENTRY LAYOUT
-	   ------------------------------------------------------
-	   | Op(1) | KeyLen(2) | ValueLen(4) | Key | Value     |
-	   ------------------------------------------------------
+	   --------------------------------------------------------------
+	   | CRC(4) | Op(1) | KeyLen(2) | ValueLen(4) | Key | Value     |
+	   --------------------------------------------------------------
+	   CRC (castagnoli) covers everything after it
 	*/
 
 	keyLen := len(entry.Key)
 	valueLen := len(entry.Value)
 
-	data := make([]byte, 7+keyLen+valueLen)
+	data := make([]byte, walHeader+keyLen+valueLen)
 
-	data[0] = entry.Op
-	binary.BigEndian.PutUint32(data[1:3], uint32(keyLen))
-	binary.BigEndian.PutUint32(data[3:7], uint32(valueLen))
-	copy(data[7:], entry.Key)
-	copy(data[7+keyLen:], entry.Value)
+	data[4] = entry.Op
+	binary.BigEndian.PutUint16(data[5:7], uint16(keyLen))
+	binary.BigEndian.PutUint32(data[7:11], uint32(valueLen))
+	copy(data[walHeader:], entry.Key)
+	copy(data[walHeader+keyLen:], entry.Value)
+	return data
+}
 
+func sealEntry(data []byte) []byte {
+	binary.BigEndian.PutUint32(data[:4], crc32.Checksum(data[4:], crcTable))
 	return data
 }
 
-func (w *WAL) deserializeEntry(data []byte) *LogEntry {
-	op := data[0]
-	keyLen := binary.BigEndian.Uint32(data[1:3])
-	valueLen := binary.BigEndian.Uint32(data[3:7])
+// torn or bit-flipped records fail here
+// instead of reaching the memtable
+func (w *WAL) deserializeEntry(data []byte) (*LogEntry, error) {
+	if len(data) < walHeader {
+		return nil, ErrCorruptWal
+	}
+	op := data[4]
+	keyLen := int(binary.BigEndian.Uint16(data[5:7]))
+	valueLen := int(binary.BigEndian.Uint32(data[7:11]))
+	if len(data) != walHeader+keyLen+valueLen || op < OpPut || op > OpBatch {
+		return nil, ErrCorruptWal
+	}
+	if binary.BigEndian.Uint32(data[:4]) != crc32.Checksum(data[4:], crcTable) {
+		return nil, ErrCorruptWal
+	}
 
 	key := make([]byte, keyLen)
 	value := make([]byte, valueLen)
 
-	copy(key, data[7:7+keyLen])
-	copy(value, data[7+keyLen:7+keyLen+valueLen])
+	copy(key, data[walHeader:walHeader+keyLen])
+	copy(value, data[walHeader+keyLen:])
 
 	return &LogEntry{
 		Op:    op,
 		Key:   key,
 		Value: value,
-	}
+	}, nil
 }
 
 // Replay replays all WAL entries using an iterator
-func (w *WAL) Replay(fn func(*LogEntry) error) error {
+// corrupted records are handled as mode says and
+// byte offsets of the dropped ones are returned
+func (w *WAL) Replay(mode RecoveryMode, fn func(*LogEntry) error) ([]int64, error) {
 	it := page.Newiterator(w.page)
+	var dropped []int64
 
 	for it.Valid() {
 		pgNum := it.Next()
-		data, err := it.Get(uint16(pgNum))
-		if err != nil {
-			return err
+		data, err := it.Get(pgNum)
+
+		// header can't tell where the record ends
+		if err == io.EOF || errors.Is(err, page.ErrCorruptPage) {
+			it.Seek(w.resync(pgNum + 1))
+			err = ErrCorruptWal
+		}
+		if err != nil && err != ErrCorruptWal {
+			return dropped, err
+		}
+
+		var entry *LogEntry
+		if err == nil {
+			entry, err = w.deserializeEntry(data)
+		}
+		if err == ErrCorruptWal {
+			if mode == AbsoluteConsistency {
+				return dropped, err
+			}
+			dropped = append(dropped, int64(pgNum)*int64(w.pageSize))
+			continue
 		}
 
-		entry := w.deserializeEntry(data)
+		// a torn write is always the tail of the log
+		// good records after a bad one mean real corruption
+		if len(dropped) > 0 && mode == TolerateCorruptedTail {
+			return dropped, ErrCorruptWal
+		}
+		w.setMaxTs(entry.ts())
 		if err := fn(entry); err != nil {
-			return err
+			return dropped, err
 		}
 	}
 
-	return nil
+	// cut the torn tail. once newer logs exist it would
+	// look like corruption in the middle of the WAL
+	if len(dropped) > 0 && mode == TolerateCorruptedTail {
+		if err := w.page.Truncate(uint32(dropped[0] / int64(w.pageSize))); err != nil {
+			return dropped, err
+		}
+		w.written.Store(w.page.GetLastPage())
+	}
+	return dropped, nil
+}
+
+// first page from pgNum on where a whole valid record starts
+// headers of damaged pages can't be trusted to tell if the
+// pages after them continue a record. so every page is tried
+func (w *WAL) resync(pgNum uint32) uint32 {
+	last := w.page.GetLastPage()
+	for ; pgNum < last; pgNum++ {
+		data, _, err := w.page.Read(pgNum)
+		if err != nil {
+			continue
+		}
+		if _, err := w.deserializeEntry(data); err == nil {
+			return pgNum
+		}
+	}
+	return last
+}
+
+// Sync makes every written record durable
+// writers are done with the log before it is rolled
+// so only the newest log can end with a torn record
+func (w *WAL) Sync() error {
+	return w.page.Sync()
+}
+
+// Size of the log file
+func (w *WAL) Size() uint64 {
+	return w.page.Size()
 }
 
 // Close closes the WAL
 func (w *WAL) Close() error {
 	return w.page.Close()
 }
+
+// Remove closes the WAL and deletes its file
+func (w *WAL) Remove() error {
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return os.Remove(w.name)
+}
@@ -0,0 +1,292 @@
+package irisdb
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alimx07/IrisDB/db"
+)
+
+const testPageSize = 4096
+
+// log of n single-page records. returns their page numbers
+func writeTestWal(t *testing.T, name string, n int) []uint32 {
+	t.Helper()
+	w, err := NewWal(name, 0644, testPageSize, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var pgNums []uint32
+	for i := range n {
+		pg, err := w.Write(&LogEntry{Op: OpPut, Key: db.NewKeyAt(testKey(i), uint64(i+1)), Value: testValue(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pgNums = append(pgNums, pg)
+	}
+	return pgNums
+}
+
+// flip a byte of the record data in page pgNum
+func corruptPage(t *testing.T, name string, pgNum uint32) {
+	t.Helper()
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	off := int64(pgNum)*testPageSize + 8 + walHeader
+	b := make([]byte, 1)
+	f.ReadAt(b, off)
+	b[0] ^= 0xFF
+	if _, err := f.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// replay name and return indexes of the replayed records
+func replayTestWal(t *testing.T, name string, mode RecoveryMode) ([]int, []int64, error) {
+	t.Helper()
+	w, err := NewWal(name, 0644, testPageSize, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var got []int
+	dropped, err := w.Replay(mode, func(entry *LogEntry) error {
+		got = append(got, int(entry.ts())-1)
+		return nil
+	})
+	return got, dropped, err
+}
+
+// log of 5 records where record 2 spans 4 pages
+// returns its first page
+func writeBigTestWal(t *testing.T, name string) uint32 {
+	t.Helper()
+	w, err := NewWal(name, 0644, testPageSize, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var big uint32
+	for i := range 5 {
+		val := testValue(i)
+		if i == 2 {
+			val = make([]byte, 3*testPageSize)
+		}
+		pg, err := w.Write(&LogEntry{Op: OpPut, Key: db.NewKeyAt(testKey(i), uint64(i+1)), Value: val})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 2 {
+			big = pg
+		}
+	}
+	return big
+}
+
+func TestWalEntryChecksum(t *testing.T) {
+	w := &WAL{}
+	data := w.serializeEntry(&LogEntry{Op: OpPut, Key: db.NewKeyAt(testKey(1), 1), Value: testValue(1)})
+	if _, err := w.deserializeEntry(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 4, walHeader, len(data) - 1} {
+		bad := append([]byte{}, data...)
+		bad[i] ^= 0x01
+		if _, err := w.deserializeEntry(bad); err != ErrCorruptWal {
+			t.Errorf("flipped byte %d: Expected ErrCorruptWal, got %v", i, err)
+		}
+	}
+	if _, err := w.deserializeEntry(data[:len(data)-1]); err != ErrCorruptWal {
+		t.Errorf("Expected ErrCorruptWal for a short record, got %v", err)
+	}
+}
+
+// replay stops at a corrupted record in the middle of the log
+// and everything before it is applied
+func TestWalReplayStopsAtCorruption(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.wal")
+	pgNums := writeTestWal(t, name, 5)
+	corruptPage(t, name, pgNums[2])
+
+	got, dropped, err := replayTestWal(t, name, AbsoluteConsistency)
+	if err != ErrCorruptWal {
+		t.Fatalf("Expected ErrCorruptWal, got %v", err)
+	}
+	if len(got) != 2 || len(dropped) != 0 {
+		t.Errorf("Expected records 0 and 1 before the error, got %v", got)
+	}
+
+	got, _, err = replayTestWal(t, name, TolerateCorruptedTail)
+	if err != ErrCorruptWal || len(got) != 2 {
+		t.Errorf("Expected ErrCorruptWal after records 0 and 1, got %v, %v", got, err)
+	}
+}
+
+func TestWalRecoveryModes(t *testing.T) {
+	dir := t.TempDir()
+
+	// torn last record
+	tail := filepath.Join(dir, "tail.wal")
+	pgNums := writeTestWal(t, tail, 5)
+	corruptPage(t, tail, pgNums[4])
+	if _, _, err := replayTestWal(t, tail, AbsoluteConsistency); err != ErrCorruptWal {
+		t.Errorf("AbsoluteConsistency: Expected ErrCorruptWal, got %v", err)
+	}
+	got, dropped, err := replayTestWal(t, tail, TolerateCorruptedTail)
+	if err != nil || len(got) != 4 || len(dropped) != 1 || dropped[0] != int64(pgNums[4])*testPageSize {
+		t.Errorf("TolerateCorruptedTail: got %v, dropped %v, %v", got, dropped, err)
+	}
+	// the tail is cut so it is not reported again
+	if got, dropped, err := replayTestWal(t, tail, AbsoluteConsistency); err != nil || len(got) != 4 || len(dropped) != 0 {
+		t.Errorf("Expected the torn tail to be cut, got %v, dropped %v, %v", got, dropped, err)
+	}
+
+	// corrupted first page of a record spanning several pages
+	mid := filepath.Join(dir, "mid.wal")
+	big := writeBigTestWal(t, mid)
+	corruptPage(t, mid, big)
+
+	if _, _, err := replayTestWal(t, mid, TolerateCorruptedTail); err != ErrCorruptWal {
+		t.Errorf("TolerateCorruptedTail: Expected ErrCorruptWal, got %v", err)
+	}
+	// pages continuing the record are not records of their own
+	got, dropped, err = replayTestWal(t, mid, SkipCorruptedRecords)
+	if err != nil || len(got) != 4 || len(dropped) != 1 || dropped[0] != int64(big)*testPageSize {
+		t.Errorf("SkipCorruptedRecords: got %v, dropped %v, %v", got, dropped, err)
+	}
+}
+
+// a garbage header loses the overflow bit so
+// later pages of the record look like records of their own
+func TestWalResyncGarbageHeader(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.wal")
+	big := writeBigTestWal(t, name)
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0x12, 0x34, 0x56, 0x78}, int64(big)*testPageSize)
+	f.Close()
+
+	got, dropped, err := replayTestWal(t, name, SkipCorruptedRecords)
+	if err != nil || len(got) != 4 || len(dropped) != 1 || dropped[0] != int64(big)*testPageSize {
+		t.Errorf("Expected records 0, 1, 3, 4 and one dropped, got %v, dropped %v, %v", got, dropped, err)
+	}
+	if _, _, err := replayTestWal(t, name, TolerateCorruptedTail); err != ErrCorruptWal {
+		t.Errorf("TolerateCorruptedTail: Expected ErrCorruptWal, got %v", err)
+	}
+}
+
+func TestWalGroupCommit(t *testing.T) {
+	// threads are interleaved even on a single cpu
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	name := filepath.Join(t.TempDir(), "test.wal")
+	w, err := NewWal(name, 0644, testPageSize, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const writers, writes = 16, 50
+	var mu sync.Mutex
+	stamps := make(map[uint64]string)
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range writes {
+				b := NewWriteBatch()
+				b.Put(testKey(i*writes+j), testValue(j))
+				ts, err := w.LogBatch(b, true)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				if _, ok := stamps[ts]; ok {
+					t.Errorf("ts %d handed out twice", ts)
+				}
+				stamps[ts] = string(testKey(i*writes + j))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// writers queued behind a leader share its append and fsync
+	groups, syncs := w.groups.Load(), w.syncs.Load()
+	if groups >= writers*writes || syncs != groups {
+		t.Errorf("Expected fewer groups than %d writes with one fsync each, got %d groups and %d fsyncs", writers*writes, groups, syncs)
+	}
+	w.Close()
+
+	// every record is in the log ordered by ts
+	w, err = NewWal(name, 0644, testPageSize, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var last uint64
+	replayed := 0
+	_, err = w.Replay(AbsoluteConsistency, func(entry *LogEntry) error {
+		b, ts, err := batchFromEntry(entry)
+		if err != nil {
+			return err
+		}
+		if ts <= last {
+			t.Errorf("ts %d logged after %d", ts, last)
+		}
+		last = ts
+		b.forEach(func(_ byte, key, _ []byte) error {
+			if stamps[ts] != string(key) {
+				t.Errorf("ts %d: expected %s, got %s", ts, stamps[ts], key)
+			}
+			return nil
+		})
+		replayed++
+		return nil
+	})
+	if err != nil || replayed != writers*writes {
+		t.Errorf("Expected %d records, got %d, %v", writers*writes, replayed, err)
+	}
+}
+
+// a failed append is reported to every writer of its group
+func TestWalGroupCommitError(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	w, err := NewWal(filepath.Join(t.TempDir(), "test.wal"), 0644, testPageSize, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.page.Close()
+
+	const writers = 16
+	errs := make(chan error, writers)
+	for i := range writers {
+		go func() {
+			b := NewWriteBatch()
+			b.Put(testKey(i), testValue(i))
+			_, err := w.LogBatch(b, true)
+			errs <- err
+		}()
+	}
+	for range writers {
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Error("Expected write to a closed log to fail")
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("writer never woken")
+		}
+	}
+}